@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -22,7 +24,36 @@ import (
 var (
 	data dstream.Dstream
 
-	nocenter = []string{"Time", "CvrgStart", "CvrgEnd", "HF", "HFDate", "DOB", "Weight"}
+	nocenter = []string{"ID", "Time", "CvrgStart", "CvrgEnd", "HF", "HFDate", "DOB", "SampProb", "Weight",
+		"SubCohort", "MatchSet", "SetCase", "SetTime", "Start", "EventType", "Region", "Emprel"}
+
+	// Variables kept in the model data but not used as covariates
+	keepvars = []string{"Time", "HF", "Weight"}
+
+	// Nested case-control data are fit with a Cox model stratified
+	// on the matched sets
+	ncc bool
+
+	// Counting-process data, with one row per (Start, Time] interval
+	counting bool
+
+	// Factors (Region, Emprel) whose indicators are added to every
+	// model
+	adjust []string
+
+	// If not empty, the factor (Region or Emprel) used to stratify
+	// the Cox models
+	strata string
+
+	// Times (days since the end of the baseline window) at which the
+	// Fine-Gray cumulative incidence predictions are reported
+	cifTimes = []float64{365, 730, 1095}
+)
+
+const (
+	// Spacing, in days, of the grid on which the Fine-Gray IPCW
+	// weights are updated
+	fgGrid = 30
 )
 
 func drugGroupMain(vnames, ee []string) []string {
@@ -66,9 +97,38 @@ func drugGroupInter(vnames, ee []string) []string {
 	return ee
 }
 
+// drugIntensityMain adds the proportion of days covered and the
+// number of fills for each drug group.
+func drugIntensityMain(vnames, ee []string) []string {
+	for _, x := range vnames {
+		if strings.HasPrefix(x, "RxPDC_") || strings.HasPrefix(x, "RxFills_") {
+			ee = append(ee, x)
+		}
+	}
+	return ee
+}
+
+// utilMain adds the health care utilization counts.
+func utilMain(vnames, ee []string) []string {
+	for _, x := range vnames {
+		switch x {
+		case "OutVisits", "EDVisits", "InpAdmits", "InpDays":
+			ee = append(ee, x)
+		}
+	}
+	return ee
+}
+
+// elixCov returns true if x is an Elixhauser indicator used as a
+// covariate.  CHF is the outcome, and the ElixPI_ indicators (primary
+// inpatient diagnoses) are not used.
+func elixCov(x string) bool {
+	return strings.HasPrefix(x, "Elix_") && x != "Elix_CHF"
+}
+
 func elixInter(vnames, ee []string) []string {
 	for _, x := range vnames {
-		if strings.HasPrefix(x, "Elix") && x != "Elix_CHF" {
+		if elixCov(x) {
 			ee = append(ee, x)
 			ee = append(ee, "Age*"+x)
 			ee = append(ee, "Female*"+x)
@@ -80,7 +140,7 @@ func elixInter(vnames, ee []string) []string {
 
 func elixMain(vnames, ee []string) []string {
 	for _, x := range vnames {
-		if strings.HasPrefix(x, "Elix") && x != "Elix_CHF" {
+		if elixCov(x) {
 			ee = append(ee, x)
 		}
 	}
@@ -108,6 +168,22 @@ func procGroupInter(vnames, ee []string) []string {
 	return ee
 }
 
+// factorMain adds the indicators for all levels but the first of a
+// factor.
+func factorMain(vnames, ee []string, fac string) []string {
+	var lev []string
+	for _, x := range vnames {
+		if strings.HasPrefix(x, fac+"_") {
+			lev = append(lev, x)
+		}
+	}
+	sort.Strings(lev)
+	if len(lev) > 1 {
+		ee = append(ee, lev[1:]...)
+	}
+	return ee
+}
+
 func modeldata(model int, fl_save bool, fl_fullrank bool, fl_qr bool, ko bool) dstream.Dstream {
 
 	var base = []string{"Age", "Female", "Age*Female"}
@@ -115,6 +191,10 @@ func modeldata(model int, fl_save bool, fl_fullrank bool, fl_qr bool, ko bool) d
 	ee = append(ee, base...)
 	vnames := data.Names()
 
+	for _, fac := range adjust {
+		ee = factorMain(vnames, ee, fac)
+	}
+
 	switch model {
 	case 0:
 		// Base model, demographics only
@@ -138,14 +218,23 @@ func modeldata(model int, fl_save bool, fl_fullrank bool, fl_qr bool, ko bool) d
 		ee = elixInter(vnames, ee)
 		ee = drugGroupInter(vnames, ee)
 		ee = procGroupInter(vnames, ee)
+	case 9:
+		ee = drugGroupMain(vnames, ee)
+		ee = drugIntensityMain(vnames, ee)
+	case 10:
+		ee = utilMain(vnames, ee)
+	case 11:
+		ee = elixMain(vnames, ee)
+		ee = drugGroupMain(vnames, ee)
+		ee = procGroupMain(vnames, ee)
+		ee = utilMain(vnames, ee)
 	}
 
 	fml := strings.Join(ee, " + ")
 	fmt.Printf(fml + "\n")
 
-	keep := []string{"Time", "HF", "Weight"}
 	// keep variables in dstream but not in formula
-	dx := formula.New(fml, data).Keep(keep).Done()
+	dx := formula.New(fml, data).Keep(keepvars).Done()
 
 	fmt.Printf("\n---Variable names after formula parsing---%v\n\n", dx.Names())
 
@@ -163,13 +252,13 @@ func modeldata(model int, fl_save bool, fl_fullrank bool, fl_qr bool, ko bool) d
 		var frcpr []float64
 		if fl_qr {
 			fmt.Printf("\n--Finding set of linearly independent columns using rank-revealing QR--\n")
-			fr := dimred.NewRRQR(dx).Keep("Time", "HF", "Weight").LogFile(lfn).Tol(1e-5).Done()
+			fr := dimred.NewRRQR(dx).Keep(keepvars...).LogFile(lfn).Tol(1e-5).Done()
 			pcheck = fr.DimCheck()
 			frcpr = fr.CPR()
 			dx = fr.Data()
 		} else {
 			fmt.Printf("\n--Finding set of linearly independent columns using Cholesky--\n")
-			fr := dimred.NewFullRank(dx).Keep("Time", "HF", "Weight").LogFile(lfn).Tol(1e-5).Done()
+			fr := dimred.NewFullRank(dx).Keep(keepvars...).LogFile(lfn).Tol(1e-5).Done()
 			pcheck = fr.DimCheck()
 			frcpr = fr.CPR()
 			dx = fr.Data()
@@ -275,7 +364,7 @@ func dropDrugs(da dstream.Dstream, dropProp float64) dstream.Dstream {
      	for _, v := range da.Names() {
 	    for _, tgname := range droptg {
 	    	// assuming no drug-drug interactions
-	    	if strings.Contains(v, tgname) {
+	    	if strings.Contains(v, tgname) || (strings.HasPrefix(v, "Rx") && strings.HasSuffix(v, tgname[2:])) {
 		   dropvars = append(dropvars, v)
 		}
 	    }
@@ -291,7 +380,7 @@ func ridge(mode int, l2w []float64, ko bool, fl_save bool, fl_fullrank bool, fl_
 
 	da := modeldata(mode, fl_save, fl_fullrank, fl_qr, ko)
 	
-	if mode == 3 || mode == 4 || mode == 7 || mode == 8 {
+	if mode == 3 || mode == 4 || mode == 7 || mode == 8 || mode == 9 || mode == 11 {
 	   da = dropDrugs(da, dropDrugProp)
 	   da.Reset()
 	   fmt.Printf("\nVariable names after dropping drug groups with low proportion of positive values: %v\n", da.Names())
@@ -309,9 +398,13 @@ func ridge(mode int, l2w []float64, ko bool, fl_save bool, fl_fullrank bool, fl_
 
 	if ko {
 		// Names to knockoff
+		kv := make(map[string]bool)
+		for _, v := range keepvars {
+			kv[v] = true
+		}
 		var names []string
 		for _, v := range da.Names() {
-			if v != "Time" && v != "HF" && v != "Weight" {
+			if !kv[v] {
 				names = append(names, v)
 			}
 		}
@@ -341,7 +434,7 @@ func ridge(mode int, l2w []float64, ko bool, fl_save bool, fl_fullrank bool, fl_
 		go func(w float64) {
 
 			var l2wgt []float64
-			for k := 0; k < len(da.Names())-3; k++ {
+			for k := 0; k < len(da.Names())-len(keepvars); k++ {
 				l2wgt = append(l2wgt, w)
 			}
 
@@ -350,7 +443,20 @@ func ridge(mode int, l2w []float64, ko bool, fl_save bool, fl_fullrank bool, fl_
 			// dx := dstream.Shallow(da)
 			dx = da
 
-			model := duration.NewPHReg(dx, "Time", "HF").OptSettings(opt).L2Weight(l2wgt).Weight("Weight")
+			var model *duration.PHReg
+			if ncc {
+				// Conditional likelihood for the matched sets, no weights
+				model = duration.NewPHReg(dx, "SetTime", "SetCase").OptSettings(opt).L2Weight(l2wgt).Strata("MatchSet")
+			} else {
+				model = duration.NewPHReg(dx, "Time", "HF").OptSettings(opt).L2Weight(l2wgt).Weight("Weight")
+			}
+			if counting {
+				// Late entry at the start of each interval
+				model = model.Entry("Start")
+			}
+			if strata != "" {
+				model = model.Strata(strata)
+			}
 			if !ko {
 				// With knockoff we are already using normed data
 				model = model.Norm()
@@ -394,7 +500,7 @@ func ridge(mode int, l2w []float64, ko bool, fl_save bool, fl_fullrank bool, fl_
 
 	fid, err := os.Create(fname)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer fid.Close()
 	for k := 0; k < len(l2w); k++ {
@@ -418,6 +524,317 @@ func ridge(mode int, l2w []float64, ko bool, fl_save bool, fl_fullrank bool, fl_
 	return nil
 }
 
+// getCols reads all the variables of a dstream into memory.
+func getCols(da dstream.Dstream) ([]string, [][]float64) {
+
+	names := da.Names()
+	cols := make([][]float64, len(names))
+
+	da.Reset()
+	for da.Next() {
+		for k := range names {
+			cols[k] = append(cols[k], da.GetPos(k).([]float64)...)
+		}
+	}
+
+	return names, cols
+}
+
+// censorSurv returns the weighted Kaplan-Meier estimate of the
+// censoring survival function G, with events (HF or death) taken to
+// occur before censoring at tied times.  The returned function gives
+// G(t) if left is false, and G(t-) if left is true.
+func censorSurv(tm, evtype, wt []float64) func(t float64, left bool) float64 {
+
+	ii := make([]int, len(tm))
+	for i := range ii {
+		ii[i] = i
+	}
+	sort.Slice(ii, func(a, b int) bool { return tm[ii[a]] < tm[ii[b]] })
+
+	// Total weight at risk
+	var risk float64
+	for _, w := range wt {
+		risk += w
+	}
+
+	// Jump times and the value of G after each jump
+	var jt, gv []float64
+	g := 1.0
+	for i := 0; i < len(ii); {
+		t := tm[ii[i]]
+		var dc, dr float64
+		for ; i < len(ii) && tm[ii[i]] == t; i++ {
+			w := wt[ii[i]]
+			dr += w
+			if evtype[ii[i]] == 0 {
+				dc += w
+			}
+		}
+		if dc > 0 {
+			// The events at t have left the risk set
+			g *= 1 - dc/(risk-(dr-dc))
+			jt = append(jt, t)
+			gv = append(gv, g)
+		}
+		risk -= dr
+	}
+
+	return func(t float64, left bool) float64 {
+		var j int
+		if left {
+			j = sort.SearchFloat64s(jt, t)
+		} else {
+			j = sort.Search(len(jt), func(i int) bool { return jt[i] > t })
+		}
+		if j == 0 {
+			return 1
+		}
+		return gv[j-1]
+	}
+}
+
+// fgExpand forms the counting-process data for a Fine-Gray model.
+// Subjects with heart failure or censoring contribute one row.
+// Subjects who die remain in the risk set after their death, with
+// weights G(t-)/G(T-), where T is the time of death (Geskus, 2011).
+// These weights are updated on a grid with spacing fgGrid days.  The
+// returned data contain the covariates and Start, Stop, FGStatus and
+// FGWeight, along with the subject index of each row.
+func fgExpand(names []string, cols [][]float64) ([]string, [][]float64, []int) {
+
+	pos := make(map[string]int)
+	for k, na := range names {
+		pos[na] = k
+	}
+	tm := cols[pos["Time"]]
+	evtype := cols[pos["EventType"]]
+	wt := cols[pos["Weight"]]
+
+	kv := make(map[string]bool)
+	for _, v := range keepvars {
+		kv[v] = true
+	}
+	var covix []int
+	var fnames []string
+	for k, na := range names {
+		if !kv[na] {
+			covix = append(covix, k)
+			fnames = append(fnames, na)
+		}
+	}
+	fnames = append(fnames, "Start", "Stop", "FGStatus", "FGWeight")
+	ncov := len(covix)
+	fcols := make([][]float64, len(fnames))
+
+	var tmax float64
+	for _, t := range tm {
+		tmax = math.Max(tmax, t)
+	}
+
+	gf := censorSurv(tm, evtype, wt)
+
+	var subj []int
+	addrow := func(i int, start, stop, status, w float64) {
+		for j, k := range covix {
+			fcols[j] = append(fcols[j], cols[k][i])
+		}
+		fcols[ncov] = append(fcols[ncov], start)
+		fcols[ncov+1] = append(fcols[ncov+1], stop)
+		fcols[ncov+2] = append(fcols[ncov+2], status)
+		fcols[ncov+3] = append(fcols[ncov+3], w)
+		subj = append(subj, i)
+	}
+
+	for i := range tm {
+
+		switch evtype[i] {
+		case 0:
+			addrow(i, 0, tm[i], 0, wt[i])
+		case 1:
+			addrow(i, 0, tm[i], 1, wt[i])
+		case 2:
+			addrow(i, 0, tm[i], 0, wt[i])
+			g0 := gf(tm[i], true)
+			a := tm[i]
+			for b := fgGrid * (math.Floor(a/fgGrid) + 1); a < tmax; b += fgGrid {
+				b = math.Min(b, tmax)
+				w := wt[i] * gf(a, false) / g0
+				if w <= 0 {
+					break
+				}
+				addrow(i, a, b, 0, w)
+				a = b
+			}
+		}
+	}
+
+	return fnames, fcols, subj
+}
+
+// fgCIF returns the weighted average, over subjects, of the predicted
+// cumulative incidence at each time in cifTimes.  The baseline
+// cumulative subdistribution hazard is the Breslow estimate.  lp
+// contains the linear predictor for each row.
+func fgCIF(start, stop, status, wgt, lp []float64, subj []int) []float64 {
+
+	n := len(stop)
+	byStart := make([]int, n)
+	byStop := make([]int, n)
+	var evt []int
+	for i := 0; i < n; i++ {
+		byStart[i] = i
+		byStop[i] = i
+		if status[i] == 1 {
+			evt = append(evt, i)
+		}
+	}
+	sort.Slice(byStart, func(a, b int) bool { return start[byStart[a]] < start[byStart[b]] })
+	sort.Slice(byStop, func(a, b int) bool { return stop[byStop[a]] < stop[byStop[b]] })
+	sort.Slice(evt, func(a, b int) bool { return stop[evt[a]] < stop[evt[b]] })
+
+	// Cumulative baseline hazard at each time in cifTimes
+	chaz := make([]float64, len(cifTimes))
+
+	// Rows with start < t <= stop are at risk at time t
+	var risk, cum float64
+	var i1, i2 int
+	for i := 0; i < len(evt); {
+		t := stop[evt[i]]
+		for ; i1 < n && start[byStart[i1]] < t; i1++ {
+			r := byStart[i1]
+			risk += wgt[r] * math.Exp(lp[r])
+		}
+		for ; i2 < n && stop[byStop[i2]] < t; i2++ {
+			r := byStop[i2]
+			risk -= wgt[r] * math.Exp(lp[r])
+		}
+		var d float64
+		for ; i < len(evt) && stop[evt[i]] == t; i++ {
+			d += wgt[evt[i]]
+		}
+		if risk > 0 {
+			// Events at time zero are not in any risk set
+			cum += d / risk
+		}
+		for k, ct := range cifTimes {
+			if t <= ct {
+				chaz[k] = cum
+			}
+		}
+	}
+
+	// Average over subjects, using the first row of each subject
+	cif := make([]float64, len(cifTimes))
+	var wtot float64
+	for i := range subj {
+		if i > 0 && subj[i] == subj[i-1] {
+			continue
+		}
+		wtot += wgt[i]
+		for k := range cifTimes {
+			cif[k] += wgt[i] * (1 - math.Exp(-chaz[k]*math.Exp(lp[i])))
+		}
+	}
+	for k := range cif {
+		cif[k] /= wtot
+	}
+
+	return cif
+}
+
+// fgrec contains the results of one Fine-Gray fit
+type fgrec struct {
+	l2w    float64
+	result *duration.PHResults
+	cif    []float64
+}
+
+// finegray fits Fine-Gray subdistribution hazards models for heart
+// failure, with death as a competing event, using the given model
+// specification and L2 weights.
+func finegray(mode int, l2w []float64, fl_save bool, fl_fullrank bool, fl_qr bool, dropDrugProp float64) error {
+
+	da := modeldata(mode, fl_save, fl_fullrank, fl_qr, false)
+
+	if mode == 3 || mode == 4 || mode == 7 || mode == 8 || mode == 9 || mode == 11 {
+		da = dropDrugs(da, dropDrugProp)
+	}
+
+	names, cols := getCols(da)
+	fnames, fcols, subj := fgExpand(names, cols)
+	fmt.Printf("Fine-Gray data have %d rows for %d subjects\n", len(subj), len(cols[0]))
+
+	var fa [][]interface{}
+	for _, c := range fcols {
+		fa = append(fa, []interface{}{c})
+	}
+	fdata := dstream.NewFromArrays(fa, fnames)
+	ncov := len(fnames) - 4
+
+	opt := optimize.DefaultSettings()
+	opt.GradientThreshold = 1e-3
+
+	rc := make(chan *fgrec, len(l2w))
+
+	for _, w := range l2w {
+
+		go func(w float64) {
+
+			var l2wgt []float64
+			for k := 0; k < ncov; k++ {
+				l2wgt = append(l2wgt, w)
+			}
+
+			fdata.Reset()
+			model := duration.NewPHReg(fdata, "Stop", "FGStatus").Entry("Start").Weight("FGWeight")
+			model = model.OptSettings(opt).L2Weight(l2wgt).Norm().Done()
+			result, err := model.Fit()
+			if err != nil {
+				rc <- nil // Need to put something down the channel
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			lp := result.FittedValues(nil)
+			cif := fgCIF(fcols[ncov], fcols[ncov+1], fcols[ncov+2], fcols[ncov+3], lp, subj)
+			rc <- &fgrec{w, result, cif}
+		}(w)
+	}
+
+	ts := time.Now().Format("Jan2-15-04-05")
+	fname := fmt.Sprintf("fg_coeff_%d_%s.txt", mode, ts)
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	for k := 0; k < len(l2w); k++ {
+		r := <-rc
+		if r == nil {
+			continue
+		}
+		fid.WriteString(fmt.Sprintf("L2=%f\n", r.l2w))
+		fid.WriteString(r.result.Summary() + "\n")
+
+		fid.WriteString("Subdistribution hazard ratios:\n")
+		pnames := r.result.Names()
+		params := r.result.Params()
+		for i := range params {
+			fid.WriteString(fmt.Sprintf("%-30s %f\n", pnames[i], math.Exp(params[i])))
+		}
+
+		fid.WriteString("Mean predicted cumulative incidence:\n")
+		for i, t := range cifTimes {
+			fid.WriteString(fmt.Sprintf("%.0f years: %f\n", t/365, r.cif[i]))
+		}
+		fid.WriteString("\n")
+	}
+
+	return nil
+}
+
 func center(data dstream.Dstream) dstream.Dstream {
 
 	means := make([]float64, data.NumVar())
@@ -463,15 +880,12 @@ func center(data dstream.Dstream) dstream.Dstream {
 
 func genvars() {
 
+	// Inverse probability of inclusion in the sample
 	f := func(v map[string]interface{}, x interface{}) {
 		wt := x.([]float64)
-		hf := v["HF"].([]float64)
-		for i := range hf {
-			if hf[i] == 1 {
-				wt[i] = 1
-			} else {
-				wt[i] = 10
-			}
+		sprob := v["SampProb"].([]float64)
+		for i := range sprob {
+			wt[i] = 1 / sprob[i]
 		}
 	}
 	data = dstream.Generate(data, "Weight", f, "float64")
@@ -497,14 +911,61 @@ func genvars() {
 
 func main() {
 
-	var ko, fl_fullrank, fl_qr, fl_save bool
+	var ko, fl_fullrank, fl_qr, fl_save, fl_fg bool
+	var fl_adjust string
 	flag.BoolVar(&ko, "knockoff", false, "Use knockoff method")
+	flag.BoolVar(&fl_fg, "finegray", false, "Fit Fine-Gray models with death as a competing event")
+	flag.StringVar(&fl_adjust, "adjust", "", "Comma-separated factors (Region, Emprel) to adjust for in every model")
+	flag.StringVar(&strata, "strata", "", "Factor (Region or Emprel) used to stratify the Cox models")
 	flag.BoolVar(&fl_save, "save", false, "Save sample of records")
 	flag.BoolVar(&fl_fullrank, "fullrank", false, "Find maximal set of linearly independent columns")
 	flag.BoolVar(&fl_qr, "qr", false, "Use rank-revealing QR to drop redundant columns")
 	flag.Parse()
-	fmt.Printf("ko: %v\nfullrank: %v\nqr: %v\nsave records: %v\n", ko, fl_fullrank, fl_qr, fl_save)
+	fmt.Printf("ko: %v\nfullrank: %v\nqr: %v\nsave records: %v\nfinegray: %v\n", ko, fl_fullrank, fl_qr, fl_save, fl_fg)
 	data = dstream.NewBCols("data", 100000).Done()
+	if fl_fg {
+		if ko {
+			fmt.Printf("Knockoffs are not available for Fine-Gray models\n")
+			os.Exit(1)
+		}
+		keepvars = append(keepvars, "EventType")
+	}
+	for _, na := range data.Names() {
+		switch na {
+		case "MatchSet":
+			fmt.Printf("Nested case-control data, stratifying on the matched sets\n")
+			ncc = true
+			keepvars = append(keepvars, "SetTime", "SetCase", "MatchSet")
+		case "Start":
+			fmt.Printf("Counting-process data, using Start as the entry time\n")
+			counting = true
+			keepvars = append(keepvars, "Start")
+		}
+	}
+	if fl_fg && (ncc || counting) {
+		fmt.Printf("Fine-Gray models require one record per subject\n")
+		os.Exit(1)
+	}
+	if fl_adjust != "" {
+		adjust = strings.Split(fl_adjust, ",")
+	}
+	for _, fac := range append(adjust, strata) {
+		if fac != "" && fac != "Region" && fac != "Emprel" {
+			fmt.Printf("Unknown factor %s\n", fac)
+			os.Exit(1)
+		}
+	}
+	if strata != "" {
+		if ncc {
+			fmt.Printf("Nested case-control models are already stratified on the matched sets\n")
+			os.Exit(1)
+		}
+		if fl_fg {
+			fmt.Printf("Stratified Fine-Gray models are not supported\n")
+			os.Exit(1)
+		}
+		keepvars = append(keepvars, strata)
+	}
 	genvars()
 	data = center(data)
 
@@ -516,10 +977,20 @@ func main() {
 	// l2w := []float64{0.1} 
 	l2w := []float64{0.05, 0.1, 0.2, 0.4, 0.8, 1.6}
 	//fmt.Printf("Restricting to a single hyperparameter value\n")
+	failed := false
 	for k := 4; k < 6; k++ {
-		err := ridge(k, l2w, ko, fl_save, fl_fullrank, fl_qr, dropDrugProp)
+		var err error
+		if fl_fg {
+			err = finegray(k, l2w, fl_save, fl_fullrank, fl_qr, dropDrugProp)
+		} else {
+			err = ridge(k, l2w, ko, fl_save, fl_fullrank, fl_qr, dropDrugProp)
+		}
 		if err != nil {
-			print(err)
+			fmt.Fprintf(os.Stderr, "basic: k=%d: %v\n", k, err)
+			failed = true
 		}
 	}
+	if failed {
+		os.Exit(1)
+	}
 }
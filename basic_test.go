@@ -0,0 +1,74 @@
+package main
+
+// Run with: go test basic.go basic_test.go
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// The column names written by data, with the ElixPI_ indicators
+var testNames = []string{"Age", "Female", "Elix_CHF", "Elix_DM", "Elix_HTN", "ElixPI_CHF",
+	"ElixPI_DM", "HFPI", "HFSrc", "TG_01", "VanWalraven"}
+
+func TestElixCovariates(t *testing.T) {
+
+	base := []string{"Age", "Female", "Age*Female"}
+
+	got := elixMain(testNames, append([]string(nil), base...))
+	want := append(append([]string(nil), base...), "Elix_DM", "Elix_HTN")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("model 1: got %v, want %v", got, want)
+	}
+
+	got = elixInter(testNames, append([]string(nil), base...))
+	want = append(append([]string(nil), base...),
+		"Elix_DM", "Age*Elix_DM", "Female*Elix_DM", "Age*Female*Elix_DM",
+		"Elix_HTN", "Age*Elix_HTN", "Female*Elix_HTN", "Age*Female*Elix_HTN")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("model 2: got %v, want %v", got, want)
+	}
+}
+
+func TestCensorSurv(t *testing.T) {
+
+	for k, tc := range []struct {
+		tm, evtype, wt []float64
+
+		// Times at which G is checked, and G(t), G(t-)
+		at, g, gl []float64
+	}{
+		{
+			// An event and a censoring at t=1: the censoring is
+			// at risk with 3 subjects, G(1) = 2/3, and G(2) =
+			// 2/3 * 1/2
+			tm:     []float64{1, 1, 2, 3},
+			evtype: []float64{1, 0, 0, 2},
+			wt:     []float64{1, 1, 1, 1},
+			at:     []float64{0.5, 1, 2, 3},
+			g:      []float64{1, 2.0 / 3, 1.0 / 3, 1.0 / 3},
+			gl:     []float64{1, 1, 2.0 / 3, 1.0 / 3},
+		},
+		{
+			// Weighted: a death of weight 2 tied with a
+			// censoring of weight 1, G(1) = 1 - 1/2
+			tm:     []float64{1, 1, 2},
+			evtype: []float64{2, 0, 0},
+			wt:     []float64{2, 1, 1},
+			at:     []float64{1, 2},
+			g:      []float64{0.5, 0},
+			gl:     []float64{1, 0.5},
+		},
+	} {
+		g := censorSurv(tc.tm, tc.evtype, tc.wt)
+		for i, t1 := range tc.at {
+			if v := g(t1, false); math.Abs(v-tc.g[i]) > 1e-12 {
+				t.Errorf("case %d: G(%v) = %v, want %v", k, t1, v, tc.g[i])
+			}
+			if v := g(t1, true); math.Abs(v-tc.gl[i]) > 1e-12 {
+				t.Errorf("case %d: G(%v-) = %v, want %v", k, t1, v, tc.gl[i])
+			}
+		}
+	}
+}
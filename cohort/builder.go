@@ -0,0 +1,673 @@
+package cohort
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/brookluers/hfp/utils"
+)
+
+// Builder builds the record of each subject.  A Builder is not
+// modified by Build, and can be shared by concurrent goroutines.
+type Builder struct {
+
+	// The cohort definition
+	Spec *utils.CohortSpec
+
+	// Int codes corresponding to heart faiure ICD codes
+	HFCodes []int
+
+	// The rule determining heart failure onset from the diagnoses
+	Phenotype *utils.Phenotype
+
+	// Names of the Elixhauser categories, and the sorted int codes
+	// of the ICD codes in each category
+	ElixNames []string
+	Elix      [][]int
+
+	// Sorted int codes of the ICD-9 and ICD-10 codes in each
+	// Charlson category, the ICD-10 codes are used for claims from
+	// utils.ICD10Start
+	Charlson   [][]int
+	Charlson10 [][]int
+
+	// Key used to pseudonymize enrollee ids, if nil the raw ids are
+	// written
+	IDKey []byte
+}
+
+// Build returns the record of the subject with the given claims, one
+// Claims value per table, in the order of the cohort specification
+// (nil if the subject has no claims in a table).  If the subject is
+// not in the cohort, the record is nil and the reason is one of the
+// utils.Attr exclusion steps.  In the nested case-control design the
+// record is for the pool from which NCCSample forms the matched sets.
+func (b *Builder) Build(tabs []Claims) (*utils.Drec, string) {
+	st := new(State)
+	b.Scan(st, tabs)
+	return b.Record(st)
+}
+
+// Scan adds the subject's claims to the state.  The claims are given
+// as for Build, and must follow any claims scanned earlier.
+func (b *Builder) Scan(st *State, tabs []Claims) {
+
+	spec := b.Spec
+
+	if st.ID == 0 {
+		st.ID = SubjectID(tabs)
+	}
+
+	// Length of the baseline window
+	bl := uint16(spec.BaselineDays)
+
+	// Enrollment, and the first day of the new enrollment rows
+	var since uint16
+	if adata := tabs[0]; adata != nil {
+		ayear := adata.Get("Year").([]uint16)
+		amemdays := adata.Get("Memdays").([]uint16)
+		if len(st.Years) == 0 {
+			st.DOB = adata.Get("Dobyr").([]uint16)[0]
+			st.Sex = adata.Get("Sex").([]uint8)[0]
+			st.Region = adata.Get("Region").([]uint8)[0]
+			st.Emprel = adata.Get("Emprel").([]uint8)[0]
+		}
+		for i, y := range ayear {
+			if d := edays(int(y)); i == 0 || d < since {
+				since = d
+			}
+		}
+		st.Years = append(st.Years, ayear...)
+		st.Memdays = append(st.Memdays, amemdays...)
+	}
+
+	// The baseline window
+	var d0 uint16
+	if year0, _ := b.getEligible(st.Years, st.Memdays); year0 != -1 {
+		d0 = edays(year0)
+	}
+	if d0 != st.D0 {
+		// The claims before the new enrollment rows were read by an
+		// earlier scan, without collecting the baseline features.
+		if d0 != 0 && d0 < since {
+			st.Stale = true
+		}
+		st.resetBaseline(d0, len(b.Elix), len(b.Charlson))
+	}
+
+	// Last day of the baseline window
+	b1 := d0 + bl
+
+	// Only the heart failure diagnoses and deaths are collected if
+	// there is no eligible year
+	base := d0 != 0
+
+	// Loop over tables
+	for j := range spec.Tables {
+
+		// Skip files that contain no useful information
+		ts := &spec.Tables[j]
+		vb := ts.Name
+		tb := tabs[j]
+		if vb == "A" || tb == nil {
+			continue
+		}
+
+		// The time values
+		sd := tb.Get(ts.DateVar).([]uint16)
+
+		// Drug information
+		if vb == "D" && base {
+			thr := tb.Get("Thergrp").([]uint8)
+
+			// Days supply and NDC, if available
+			var dsup []uint16
+			if ts.Has("Daysupp") {
+				dsup = tb.Get("Daysupp").([]uint16)
+				st.HasDaysupp = true
+			}
+			var ndc []uint64
+			if ts.Has("Ndcnum") {
+				ndc = tb.Get("Ndcnum").([]uint64)
+			}
+
+			// Rows with the same date and NDC are one fill
+			type fill struct {
+				date uint16
+				ndc  uint64
+			}
+			fills := make(map[fill]bool)
+
+			for i, t := range thr {
+				if t == 0 || t > utils.NumThrgrp || sd[i] < d0 {
+					continue
+				}
+				firstDate(&st.ThrgrpFirst[t-1], sd[i])
+				if sd[i] > b1 {
+					continue
+				}
+				st.Thrgrp[t-1] = true
+
+				if ndc != nil {
+					f := fill{sd[i], ndc[i]}
+					if fills[f] {
+						continue
+					}
+					fills[f] = true
+				}
+
+				fl := Fill{Group: t - 1, Date: sd[i]}
+				if dsup != nil {
+					fl.Days = dsup[i]
+				}
+				st.Fills = append(st.Fills, fl)
+			}
+		}
+
+		// Inpatient discharges, used to identify deaths
+		if vb == "I" && (spec.Death.Discharge || spec.Death.Disenroll) {
+			dst := tb.Get("Dstatus").([]uint8)
+			dsd := tb.Get("Disdate").([]uint16)
+			for i := range dst {
+				if spec.Death.Discharge && utils.IsDeathStatus(dst[i]) {
+					firstDate(&st.Death, dsd[i])
+				}
+				st.Discharges = append(st.Discharges, dsd[i])
+			}
+		}
+
+		// Outpatient and emergency department visits
+		if (vb == "O" || vb == "S" || vb == "F") && ts.Has("Stdplac") && base {
+			plc := tb.Get("Stdplac").([]uint8)
+			for i, p := range plc {
+				if sd[i] < d0 || sd[i] > b1 {
+					continue
+				}
+				if p == utils.EDPlace {
+					st.EDDays[sd[i]] = true
+				} else if vb == "O" {
+					st.OutDays[sd[i]] = true
+				}
+			}
+		}
+
+		// Inpatient admissions
+		if vb == "I" && ts.Has("Disdate") && base {
+			dsd := tb.Get("Disdate").([]uint16)
+			for i := range dsd {
+				if sd[i] >= d0 && sd[i] <= b1 && dsd[i] > st.Admits[sd[i]] {
+					st.Admits[sd[i]] = dsd[i]
+				}
+			}
+		}
+
+		// Procgrp information, from every table that has it
+		if ts.Has("Procgrp") && base {
+			pcg := tb.Get("Procgrp").([]uint16)
+			for i, p := range pcg {
+				if sd[i] >= d0 && sd[i] <= b1 && p > 0 && p <= utils.NumProcgrp {
+					st.Procgrp[p-1] |= 1 << uint(j)
+				}
+			}
+		}
+
+		// Loop over the Dx variables in each file
+		for _, dv := range dxVars(ts) {
+
+			src := utils.DxSource(vb, dv == "Dx1")
+
+			// Loop through time
+			for i, y := range tb.Get(dv).([]uint64) {
+
+				// Check for heart failure
+				if matchset(b.HFCodes, int(y)) {
+					st.HFDx = append(st.HFDx, utils.HFDx{
+						Date:      sd[i],
+						Inpatient: utils.InpatientTable(vb),
+						Primary:   dv == "Dx1",
+						Src:       src,
+					})
+				}
+
+				if !base {
+					continue
+				}
+
+				// Update Elixhauser for the baseline window.
+				if sd[i] >= d0 && sd[i] <= b1 {
+					for q, ex := range b.Elix {
+						if matchset(ex, int(y)) {
+							st.Elix[q] = true
+							st.ElixSrc[q] |= src
+						}
+					}
+					charl := b.Charlson
+					if sd[i] >= utils.ICD10Start {
+						charl = b.Charlson10
+					}
+					for q, cx := range charl {
+						st.Charlson[q] = st.Charlson[q] || matchset(cx, int(y))
+					}
+				}
+
+				// Track first dates through all of follow-up
+				if spec.Intervals != "" && sd[i] >= d0 {
+					for q, ex := range b.Elix {
+						if matchset(ex, int(y)) {
+							firstDate(&st.ElixFirst[q], sd[i])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// Record returns the record of the subject with the given state, or
+// nil and the reason the subject is not in the cohort, as for Build.
+// The state is not modified.
+func (b *Builder) Record(st *State) (*utils.Drec, string) {
+
+	spec := b.Spec
+
+	// Length of the baseline window
+	bl := uint16(spec.BaselineDays)
+
+	// Get the eligible years.
+	if len(st.Years) == 0 {
+		return nil, utils.AttrNoEligible
+	}
+	year0, year1 := b.getEligible(st.Years, st.Memdays)
+	if year0 == -1 {
+		return nil, utils.AttrNoEligible
+	}
+	if year1-year0 == 1 {
+		return nil, utils.AttrOneYear
+	}
+
+	// First/last day of coverage window
+	d0 := edays(year0)
+	d1 := edays(year1)
+
+	// Last day of the baseline window
+	b1 := d0 + bl
+
+	// Follow-up starts at the end of the baseline window, which may
+	// be longer than a year
+	if d1 <= b1 {
+		return nil, utils.AttrShortCoverage
+	}
+	if st.Stale {
+		return nil, utils.AttrStale
+	}
+
+	// Heart failure onset, according to the phenotype rule
+	hfdx := append([]utils.HFDx(nil), st.HFDx...)
+	utils.SortHFDx(hfdx)
+	hfdate, hf := b.Phenotype.Date(hfdx, spec.Outcome.GapDays)
+
+	// Probable death when enrollment ends shortly after an
+	// inpatient discharge
+	ddate := st.Death
+	if spec.Death.Disenroll {
+		if ee := b.enrollEnd(st.Years, st.Memdays); ee != 0 {
+			for _, x := range st.Discharges {
+				if x <= ee && int(ee-x) <= spec.Death.Window {
+					firstDate(&ddate, ee)
+					break
+				}
+			}
+		}
+	}
+
+	// Heart failure within the baseline window, exclude
+	if hf && (hfdate < b1) {
+		return nil, utils.AttrPrevalent
+	}
+
+	// Heart failure after the prediction window is not an event
+	if hf && spec.PredictionDays > 0 && hfdate > spec.FollowupEnd(d0, d1) {
+		hf = false
+		hfdate = 0
+	}
+
+	// The event ending follow-up.  The year in which a subject
+	// dies has partial coverage, so deaths are counted through
+	// the end of the year following the last year of full
+	// coverage.
+	event, edate := utils.EventCensored, spec.FollowupEnd(d0, d1)
+	dlim := edays(year1 + 1)
+	if spec.PredictionDays > 0 {
+		dlim = edate
+	}
+	if ddate >= b1 && ddate <= dlim && (!hf || ddate < hfdate) {
+		event, edate = utils.EventDeath, ddate
+		hf, hfdate = false, 0
+	} else if hf {
+		event, edate = utils.EventHF, hfdate
+	}
+
+	// Sampling, see the Design field of utils.CohortSpec
+	sprob := 1.0
+	var subc bool
+	rate := spec.Controls.RateFor(year0-int(st.DOB), st.Sex)
+	u := utils.SampleUniform(spec.Controls.Seed, st.ID)
+	switch spec.Design {
+	case utils.DesignSRS:
+		// Take a random subsample of non-cases
+		if !hf {
+			if u >= rate {
+				return nil, utils.AttrNotSampled
+			}
+			sprob = rate
+		}
+	case utils.DesignCaseCohort:
+		// A random subcohort, plus all cases
+		subc = u < rate
+		if !hf {
+			if !subc {
+				return nil, utils.AttrNotSampled
+			}
+			sprob = rate
+		}
+	}
+
+	id := st.ID
+	if b.IDKey != nil {
+		id = utils.Pseudonym(b.IDKey, id)
+	}
+
+	procgrp, procsrc := pcomp(st.Procgrp)
+	charlson := bcomp(st.Charlson)
+
+	elix := utils.ElixHierarchy(b.ElixNames, bcomp(st.Elix))
+	elixsrc := make([]uint8, len(elix))
+	for i, j := range elix {
+		elixsrc[i] = st.ElixSrc[j]
+	}
+
+	// Where the diagnoses establishing heart failure were seen
+	var hfsrc uint8
+	if hf {
+		for _, d := range hfdx {
+			if d.Date <= hfdate {
+				hfsrc |= d.Src
+			}
+		}
+	}
+
+	// Length of stay, counting same-day stays as one day
+	var inpdays int
+	for a, d := range st.Admits {
+		if d > a {
+			inpdays += int(d - a)
+		} else {
+			inpdays++
+		}
+	}
+
+	// Drug fills, days supply and proportion of days covered, for
+	// each therapeutic group
+	var rxfills, rxdays []uint16
+	var rxpdc []float64
+	if len(st.Fills) > 0 {
+		rxfills = make([]uint16, utils.NumThrgrp)
+		var rxcov [][]bool
+		if st.HasDaysupp {
+			rxdays = make([]uint16, utils.NumThrgrp)
+			rxcov = make([][]bool, utils.NumThrgrp)
+		}
+		for _, f := range st.Fills {
+			rxfills[f.Group]++
+			if rxcov == nil {
+				continue
+			}
+			rxdays[f.Group] += f.Days
+			if rxcov[f.Group] == nil {
+				rxcov[f.Group] = make([]bool, bl+1)
+			}
+			cv := rxcov[f.Group]
+			for d := int(f.Date - d0); d < int(f.Date-d0)+int(f.Days) && d < len(cv); d++ {
+				cv[d] = true
+			}
+		}
+		if rxcov != nil {
+			rxpdc = make([]float64, utils.NumThrgrp)
+			for g, cv := range rxcov {
+				if cv == nil {
+					// No fills in the group
+					continue
+				}
+				for _, c := range cv {
+					if c {
+						rxpdc[g]++
+					}
+				}
+				rxpdc[g] /= float64(len(cv))
+			}
+		}
+	}
+
+	// A record for this subject
+	r := utils.Drec{
+		ID:         id,
+		Hf:         hf,
+		HfDate:     hfdate,
+		HfSrc:      hfsrc,
+		Event:      event,
+		EventDate:  edate,
+		CvrgStart:  d0,
+		CvrgEnd:    d1,
+		Elix:       elix,
+		ElixSrc:    elixsrc,
+		Charlson:   charlson,
+		CharlScore: uint8(utils.Charlson.Score(charlson)),
+		Thrgrp:     bcomp(st.Thrgrp),
+		RxFills:    rxfills,
+		RxDays:     rxdays,
+		RxPDC:      rxpdc,
+		OutVisits:  uint16(len(st.OutDays)),
+		EDVisits:   uint16(len(st.EDDays)),
+		InpAdmits:  uint16(len(st.Admits)),
+		InpDays:    uint16(inpdays),
+		Procgrp:    procgrp,
+		ProcSrc:    procsrc,
+		DOB:        st.DOB,
+		Sex:        st.Sex,
+		Region:     st.Region,
+		Emprel:     st.Emprel,
+		SampProb:   sprob,
+		SubCohort:  subc,
+	}
+
+	if spec.Intervals != "" {
+		r.Intervals = b.makeIntervals(b1, edate, hf, st.ElixFirst, st.ThrgrpFirst)
+	}
+
+	return &r, ""
+}
+
+// dxVars returns the names of the Dx variables read from the table.
+func dxVars(ts *utils.TableSpec) []string {
+	var u []string
+	for _, c := range ts.Columns {
+		if strings.HasPrefix(c, "Dx") {
+			u = append(u, c)
+		}
+	}
+	return u
+}
+
+// getEligible finds the longest consecutive series of years during which the subject is eligible,
+// the earliest if there are several.
+func (b *Builder) getEligible(ayear []uint16, amemdays []uint16) (int, int) {
+
+	// Years with full coverage
+	ym := make(map[int]bool)
+	for k := range ayear {
+		if int(amemdays[k]) >= b.Spec.MinCoverage {
+			ym[int(ayear[k])] = true
+		}
+	}
+
+	if len(ym) == 0 {
+		return -1, -1
+	}
+
+	year0, year1 := -1, -1
+	mxd := 0
+	for y := range ym {
+		yy := y + 1
+		for ym[yy] {
+			// advance until the year is missing
+			yy++
+		}
+		if yy-y > mxd || (yy-y == mxd && y < year0) {
+			mxd = yy - y
+			year0 = y
+			year1 = yy
+		}
+	}
+
+	return year0, year1
+}
+
+// enrollEnd returns the estimated last day of enrollment if
+// enrollment ends part way through the last year in the A table
+// (assuming enrollment runs from the start of that year), or 0 if the
+// last year has full coverage.
+func (b *Builder) enrollEnd(ayear []uint16, amemdays []uint16) uint16 {
+
+	k := 0
+	for i := range ayear {
+		if ayear[i] > ayear[k] {
+			k = i
+		}
+	}
+
+	if int(amemdays[k]) >= b.Spec.MinCoverage {
+		return 0
+	}
+
+	return edays(int(ayear[k])) + amemdays[k]
+}
+
+// makeIntervals splits follow-up, from fs to fe, into counting-process
+// intervals.  The Elixhauser categories and drug groups of each
+// interval are those first seen on or before the start of the
+// interval, based on the first dates in elxFirst and thgFirst.
+func (b *Builder) makeIntervals(fs, fe uint16, hf bool, elxFirst, thgFirst []uint16) []utils.Interval {
+
+	// Interval boundaries
+	brk := []uint16{fs}
+	switch b.Spec.Intervals {
+	case utils.IntervalsYearly:
+		for t := int(fs) + 365; t < int(fe); t += 365 {
+			brk = append(brk, uint16(t))
+		}
+	case utils.IntervalsDx:
+		var u []int
+		for _, f := range append(elxFirst, thgFirst...) {
+			if f > fs && f < fe {
+				u = append(u, int(f))
+			}
+		}
+		for _, t := range SortUniq(u) {
+			brk = append(brk, uint16(t))
+		}
+	}
+
+	// Covariates as of a given date
+	seen := func(first []uint16, t uint16) []int {
+		var u []int
+		for q, f := range first {
+			if f != 0 && f <= t {
+				u = append(u, q)
+			}
+		}
+		return u
+	}
+
+	var iv []utils.Interval
+	for i, s := range brk {
+		e := fe
+		if i+1 < len(brk) {
+			e = brk[i+1]
+		}
+		iv = append(iv, utils.Interval{
+			Start:  s - fs,
+			Stop:   e - fs,
+			Event:  hf && i == len(brk)-1,
+			Elix:   utils.ElixHierarchy(b.ElixNames, seen(elxFirst, s)),
+			Thrgrp: seen(thgFirst, s),
+		})
+	}
+
+	return iv
+}
+
+// edays takes a four digit year, and returns the elapsed days from 1-1-1960.
+func edays(year int) uint16 {
+	return uint16(365.25 * (float64(year) - 1960))
+}
+
+// firstDate updates the earliest date, f, at which something is seen
+// to be the date d if it is earlier.  Zero means not yet seen.
+func firstDate(f *uint16, d uint16) {
+	if *f == 0 || d < *f {
+		*f = d
+	}
+}
+
+// bcomp compresses a Boolean array into a list of indices where the
+// values are true.  For example, [true, false, true] becomes [0, 2].
+func bcomp(x []bool) []int {
+	var y []int
+	for i, v := range x {
+		if v {
+			y = append(y, i)
+		}
+	}
+	return y
+}
+
+// pcomp compresses an array of bit masks into a list of indices
+// where the mask is not zero, and the corresponding masks.
+func pcomp(x []uint8) ([]int, []uint8) {
+	var y []int
+	var m []uint8
+	for i, v := range x {
+		if v != 0 {
+			y = append(y, i)
+			m = append(m, v)
+		}
+	}
+	return y, m
+}
+
+// SortUniq sorts an array of integers in-place and removes
+// duplicates.
+func SortUniq(u []int) []int {
+	sort.Sort(sort.IntSlice(u))
+	j := 0
+	for i := range u {
+		if i == 0 || u[i] != u[i-1] {
+			u[j] = u[i]
+			j++
+		}
+	}
+	return u[0:j]
+}
+
+// matchset returns true or false based on whether y is an element of
+// the sorted array x.
+func matchset(x []int, y int) bool {
+
+	j := sort.SearchInts(x, y)
+
+	if j == len(x) || x[j] != y {
+		return false
+	}
+
+	return true
+}
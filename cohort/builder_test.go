@@ -0,0 +1,465 @@
+package cohort
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brookluers/hfp/utils"
+)
+
+// Integer codes of the diagnoses used in the tests
+const (
+	hfCode = 1
+	dmCode = 2
+	miCode = 3
+)
+
+// claim is one row of a claims table, the columns that are not given
+// are zero.
+type claim struct {
+	table string
+	date  uint16
+	vals  map[string]uint64
+}
+
+// enrollment is one row of the A table.
+type enrollment struct {
+	year    uint16
+	memdays uint16
+}
+
+// fullYears returns enrollment with full coverage in the given years.
+func fullYears(y0, y1 uint16) []enrollment {
+	var u []enrollment
+	for y := y0; y <= y1; y++ {
+		u = append(u, enrollment{y, 365})
+	}
+	return u
+}
+
+// dx returns a claim in the table with the given primary diagnosis.
+func dx(table string, date uint16, code uint64) claim {
+	return claim{table, date, map[string]uint64{"Dx1": code}}
+}
+
+// death returns an inpatient claim ending with a death on the given
+// date.
+func death(date uint16) claim {
+	return claim{"I", date - 3, map[string]uint64{"Disdate": uint64(date), "Dstatus": 20}}
+}
+
+// makeClaims returns the claims of subject id, as read by Build.
+func makeClaims(spec *utils.CohortSpec, id uint64, enr []enrollment, rows []claim) []Claims {
+
+	tabs := make([]Claims, len(spec.Tables))
+	for j := range spec.Tables {
+		ts := &spec.Tables[j]
+
+		var dates []uint16
+		var vals []map[string]uint64
+		if ts.Name == "A" {
+			for _, e := range enr {
+				dates = append(dates, e.year)
+				vals = append(vals, map[string]uint64{"Memdays": uint64(e.memdays),
+					"Dobyr": 1950, "Sex": 1, "Region": 2, "Emprel": 1})
+			}
+		} else {
+			for _, r := range rows {
+				if r.table == ts.Name {
+					dates = append(dates, r.date)
+					vals = append(vals, r.vals)
+				}
+			}
+		}
+		if len(dates) == 0 {
+			continue
+		}
+
+		c := make(Columns)
+		for _, v := range ts.Columns {
+			switch v {
+			case "Enrolid", "Ndcnum":
+				x := make([]uint64, len(dates))
+				for i := range x {
+					x[i] = vals[i][v]
+					if v == "Enrolid" {
+						x[i] = id
+					}
+				}
+				c[v] = x
+			case "Sex", "Region", "Emprel", "Stdplac", "Dstatus", "Thergrp":
+				x := make([]uint8, len(dates))
+				for i := range x {
+					x[i] = uint8(vals[i][v])
+				}
+				c[v] = x
+			default:
+				if strings.HasPrefix(v, "Dx") {
+					x := make([]uint64, len(dates))
+					for i := range x {
+						x[i] = vals[i][v]
+					}
+					c[v] = x
+					continue
+				}
+				x := make([]uint16, len(dates))
+				for i := range x {
+					x[i] = uint16(vals[i][v])
+				}
+				c[v] = x
+			}
+		}
+		c[ts.DateVar] = dates
+		tabs[j] = c
+	}
+
+	return tabs
+}
+
+// testSpec returns the default cohort specification, keeping all
+// controls.
+func testSpec() *utils.CohortSpec {
+	spec := utils.DefaultSpec()
+	spec.Controls.Rate = 1
+	return spec
+}
+
+// testBuilder returns a Builder with an Elixhauser category for heart
+// failure and one for diabetes, and the Charlson MI category.
+func testBuilder(t *testing.T, spec *utils.CohortSpec) *Builder {
+
+	phen, err := utils.LookupPhenotype("any")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	charl := make([][]int, len(utils.Charlson.Cats))
+	charl[0] = []int{miCode}
+
+	return &Builder{
+		Spec:       spec,
+		HFCodes:    []int{hfCode},
+		Phenotype:  phen,
+		ElixNames:  []string{"CHF", "DM"},
+		Elix:       [][]int{{hfCode}, {dmCode}},
+		Charlson:   charl,
+		Charlson10: charl,
+	}
+}
+
+func TestEligibility(t *testing.T) {
+
+	for _, tc := range []struct {
+		name     string
+		baseline int
+		enr      []enrollment
+		reason   string
+		start    uint16
+		end      uint16
+	}{
+		{
+			name:   "no full year",
+			enr:    []enrollment{{2010, 100}, {2011, 200}},
+			reason: utils.AttrNoEligible,
+		},
+		{
+			name:   "one year",
+			enr:    []enrollment{{2010, 365}, {2011, 100}},
+			reason: utils.AttrOneYear,
+		},
+		{
+			name:  "longest span",
+			enr:   append([]enrollment{{2010, 365}, {2011, 100}}, fullYears(2012, 2014)...),
+			start: edays(2012),
+			end:   edays(2015),
+		},
+		{
+			name:  "earliest of equal spans",
+			enr:   append(append(fullYears(2010, 2011), enrollment{2012, 100}), fullYears(2013, 2014)...),
+			start: edays(2010),
+			end:   edays(2012),
+		},
+		{
+			name:     "coverage ends in the baseline window",
+			baseline: 800,
+			enr:      fullYears(2010, 2011),
+			reason:   utils.AttrShortCoverage,
+		},
+	} {
+		spec := testSpec()
+		if tc.baseline != 0 {
+			spec.BaselineDays = tc.baseline
+		}
+		b := testBuilder(t, spec)
+
+		r, reason := b.Build(makeClaims(spec, 1, tc.enr, nil))
+		if reason != tc.reason {
+			t.Errorf("%s: got reason %q, want %q", tc.name, reason, tc.reason)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if r.CvrgStart != tc.start || r.CvrgEnd != tc.end {
+			t.Errorf("%s: got coverage %d-%d, want %d-%d", tc.name, r.CvrgStart, r.CvrgEnd, tc.start, tc.end)
+		}
+	}
+}
+
+func TestOutcome(t *testing.T) {
+
+	d0 := edays(2010)
+	for _, tc := range []struct {
+		name   string
+		rows   []claim
+		reason string
+		event  uint8
+		edate  uint16
+		hf     bool
+	}{
+		{
+			name:  "censored",
+			event: utils.EventCensored,
+			edate: edays(2015),
+		},
+		{
+			name:   "prevalent heart failure",
+			rows:   []claim{dx("O", d0+100, hfCode)},
+			reason: utils.AttrPrevalent,
+		},
+		{
+			name:  "incident heart failure",
+			rows:  []claim{dx("O", d0+100, dmCode), dx("I", d0+800, hfCode)},
+			event: utils.EventHF,
+			edate: d0 + 800,
+			hf:    true,
+		},
+		{
+			name:  "death",
+			rows:  []claim{death(d0 + 900)},
+			event: utils.EventDeath,
+			edate: d0 + 900,
+		},
+		{
+			name:  "death after heart failure",
+			rows:  []claim{dx("O", d0+800, hfCode), death(d0 + 900)},
+			event: utils.EventHF,
+			edate: d0 + 800,
+			hf:    true,
+		},
+		{
+			name:  "heart failure after death",
+			rows:  []claim{death(d0 + 800), dx("O", d0+900, hfCode)},
+			event: utils.EventDeath,
+			edate: d0 + 800,
+		},
+	} {
+		spec := testSpec()
+		b := testBuilder(t, spec)
+
+		r, reason := b.Build(makeClaims(spec, 1, fullYears(2010, 2014), tc.rows))
+		if reason != tc.reason {
+			t.Errorf("%s: got reason %q, want %q", tc.name, reason, tc.reason)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if r.Event != tc.event || r.EventDate != tc.edate || r.Hf != tc.hf {
+			t.Errorf("%s: got event %d on %d (HF %v), want %d on %d (HF %v)", tc.name,
+				r.Event, r.EventDate, r.Hf, tc.event, tc.edate, tc.hf)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+
+	spec := utils.DefaultSpec()
+	spec.Controls.Rate = 0.3
+	spec.Controls.Seed = 7
+	b := testBuilder(t, spec)
+
+	n, kept := 2000, 0
+	for id := uint64(1); id <= uint64(n); id++ {
+		r, reason := b.Build(makeClaims(spec, id, fullYears(2010, 2014), nil))
+		want := utils.SampleUniform(spec.Controls.Seed, id) < spec.Controls.Rate
+		if (r != nil) != want {
+			t.Fatalf("id %d: got record %v (%q), want %v", id, r != nil, reason, want)
+		}
+		if r == nil {
+			if reason != utils.AttrNotSampled {
+				t.Fatalf("id %d: got reason %q", id, reason)
+			}
+			continue
+		}
+		kept++
+		if r.SampProb != spec.Controls.Rate {
+			t.Errorf("id %d: got SampProb %v, want %v", id, r.SampProb, spec.Controls.Rate)
+		}
+	}
+	if f := float64(kept) / float64(n); math.Abs(f-spec.Controls.Rate) > 0.05 {
+		t.Errorf("kept %d of %d controls", kept, n)
+	}
+
+	// Cases are always kept
+	for id := uint64(1); id <= 50; id++ {
+		rows := []claim{dx("I", edays(2012), hfCode)}
+		r, reason := b.Build(makeClaims(spec, id, fullYears(2010, 2014), rows))
+		if r == nil || r.SampProb != 1 {
+			t.Fatalf("case %d not kept with probability 1: %v %q", id, r, reason)
+		}
+	}
+}
+
+func TestRx(t *testing.T) {
+
+	spec := testSpec()
+	b := testBuilder(t, spec)
+
+	d0 := edays(2010)
+	fill := func(date uint16, grp, days, ndc uint64) claim {
+		return claim{"D", date, map[string]uint64{"Thergrp": grp, "Daysupp": days, "Ndcnum": ndc}}
+	}
+	rows := []claim{
+		fill(d0+10, 1, 30, 5),
+		fill(d0+10, 1, 30, 5), // same fill
+		fill(d0+20, 1, 30, 6), // overlaps the first fill
+		fill(d0+100, 2, 10, 7),
+		fill(d0+500, 3, 10, 8), // after the baseline window
+	}
+
+	r, reason := b.Build(makeClaims(spec, 1, fullYears(2010, 2014), rows))
+	if r == nil {
+		t.Fatalf("no record: %q", reason)
+	}
+
+	n := float64(spec.BaselineDays + 1)
+	for _, tc := range []struct {
+		grp   int
+		fills uint16
+		days  uint16
+		pdc   float64
+	}{
+		{0, 2, 60, 40 / n},
+		{1, 1, 10, 10 / n},
+		{2, 0, 0, 0},
+		{3, 0, 0, 0},
+	} {
+		if r.RxFills[tc.grp] != tc.fills || r.RxDays[tc.grp] != tc.days {
+			t.Errorf("group %d: got %d fills, %d days, want %d, %d", tc.grp+1,
+				r.RxFills[tc.grp], r.RxDays[tc.grp], tc.fills, tc.days)
+		}
+		if !(math.Abs(r.RxPDC[tc.grp]-tc.pdc) < 1e-12) {
+			t.Errorf("group %d: got PDC %v, want %v", tc.grp+1, r.RxPDC[tc.grp], tc.pdc)
+		}
+	}
+}
+
+// split returns the claims from the years before year, or from year
+// on if after is true.
+func split(spec *utils.CohortSpec, tabs []Claims, year int, after bool) []Claims {
+
+	out := make([]Claims, len(tabs))
+	for j, tb := range tabs {
+		if tb == nil {
+			continue
+		}
+		ts := &spec.Tables[j]
+		lim := edays(year)
+		if ts.Name == "A" {
+			lim = uint16(year)
+		}
+
+		var keep []int
+		for i, d := range tb.Get(ts.DateVar).([]uint16) {
+			if (d >= lim) == after {
+				keep = append(keep, i)
+			}
+		}
+		if len(keep) == 0 {
+			continue
+		}
+
+		c := make(Columns)
+		for k, v := range tb.(Columns) {
+			x := reflect.ValueOf(v)
+			y := reflect.MakeSlice(x.Type(), len(keep), len(keep))
+			for i, q := range keep {
+				y.Index(i).Set(x.Index(q))
+			}
+			c[k] = y.Interface()
+		}
+		out[j] = c
+	}
+
+	return out
+}
+
+func TestScanRecord(t *testing.T) {
+
+	spec := testSpec()
+	spec.Intervals = utils.IntervalsDx
+	b := testBuilder(t, spec)
+
+	d0 := edays(2010)
+	rows := []claim{
+		dx("O", d0+50, dmCode),
+		dx("S", d0+60, miCode),
+		{"D", d0 + 70, map[string]uint64{"Thergrp": 4, "Daysupp": 30, "Ndcnum": 1}},
+		{"O", d0 + 80, map[string]uint64{"Procgrp": 12, "Stdplac": 11}},
+		{"I", d0 + 90, map[string]uint64{"Disdate": uint64(d0 + 94)}},
+		{"D", d0 + 700, map[string]uint64{"Thergrp": 5, "Daysupp": 30, "Ndcnum": 2}},
+		dx("O", d0+1200, hfCode),
+		dx("O", d0+1300, hfCode),
+	}
+
+	for _, tc := range []struct {
+		name  string
+		enr   []enrollment
+		year  int
+		stale bool
+	}{
+		{name: "split in baseline", enr: fullYears(2010, 2014), year: 2011},
+		{name: "split in follow-up", enr: fullYears(2010, 2014), year: 2013},
+		{name: "split before heart failure", enr: fullYears(2010, 2015), year: 2014},
+		{name: "coverage extended", enr: fullYears(2010, 2016), year: 2016},
+		{
+			name:  "baseline window moved",
+			enr:   append(append(fullYears(2010, 2011), enrollment{2012, 100}), fullYears(2013, 2015)...),
+			year:  2015,
+			stale: true,
+		},
+	} {
+		tabs := makeClaims(spec, 1, tc.enr, rows)
+		want, wreason := b.Build(tabs)
+
+		// Scan the claims in two parts, saving the state in between
+		// as hfdat does
+		st := new(State)
+		b.Scan(st, split(spec, tabs, tc.year, false))
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(st); err != nil {
+			t.Fatal(err)
+		}
+		st = new(State)
+		if err := gob.NewDecoder(&buf).Decode(st); err != nil {
+			t.Fatal(err)
+		}
+		b.Scan(st, split(spec, tabs, tc.year, true))
+		got, reason := b.Record(st)
+
+		if tc.stale {
+			if reason != utils.AttrStale {
+				t.Errorf("%s: got reason %q, want %q", tc.name, reason, utils.AttrStale)
+			}
+			continue
+		}
+		if reason != wreason || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got\n%+v (%q)\nwant\n%+v (%q)", tc.name, got, reason, want, wreason)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package cohort builds the records of the heart failure cohort,
+// one subject at a time, from the subject's claims.  The claims are
+// read through the Source and Claims interfaces, so that records can
+// be built from the MarketScan column stores or from claims held in
+// memory.
+package cohort
+
+import (
+	"github.com/brookluers/dstream/dstream"
+)
+
+// Claims holds the claims of one subject from one table.
+type Claims interface {
+
+	// Get returns the values of the named column, one per claim,
+	// sorted by date.  Columns have the types stored in the
+	// MarketScan tables, e.g. []uint16 for dates and []uint64 for
+	// diagnosis codes.
+	Get(name string) interface{}
+}
+
+// Source provides the claims of each subject in turn.
+type Source interface {
+
+	// Next advances to the next subject, returning false when there
+	// are no more subjects.
+	Next() bool
+
+	// Table returns the claims of the current subject in table j, in
+	// the order of the cohort specification, or nil if the subject
+	// has no claims in the table.
+	Table(j int) Claims
+}
+
+// Columns holds claims in memory, as a map from column names to
+// column values.
+type Columns map[string]interface{}
+
+// Get returns the values of the named column.
+func (c Columns) Get(name string) interface{} {
+	return c[name]
+}
+
+// joinSource reads the subjects from dstreams joined on Enrolid.
+type joinSource struct {
+	data []dstream.Dstream
+	wk   *dstream.Join
+}
+
+// NewJoinSource returns a Source reading from the given dstreams,
+// which must be segmented by Enrolid and sorted by Enrolid, in the
+// order of the tables in the cohort specification.
+func NewJoinSource(data []dstream.Dstream) Source {
+
+	var keys []string
+	for range data {
+		keys = append(keys, "Enrolid")
+	}
+
+	return &joinSource{
+		data: data,
+		wk:   dstream.NewJoin(data, keys),
+	}
+}
+
+// Next advances to the next subject.
+func (js *joinSource) Next() bool {
+	return js.wk.Next()
+}
+
+// Table returns the claims of the current subject in table j.
+func (js *joinSource) Table(j int) Claims {
+	if !js.wk.Status[j] {
+		return nil
+	}
+	return js.data[j]
+}
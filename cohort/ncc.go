@@ -0,0 +1,87 @@
+package cohort
+
+import (
+	"sort"
+
+	"github.com/brookluers/hfp/utils"
+)
+
+// NCCSample forms the matched sets of a nested case-control sample
+// from a pool of eligible subjects.  Each case is matched to up to
+// spec.NCCControls subjects with the same birth year, sex and region
+// who are alive, under follow-up and free of heart failure on the
+// date of the case's heart failure.  Controls are drawn using the sampling
+// seed, and may be drawn for more than one case or later become
+// cases themselves.  Each member of a set appears once in the
+// returned records for that set.  The number of cases with fewer
+// than spec.NCCControls controls is also returned.
+func NCCSample(spec *utils.CohortSpec, pool []utils.Drec) ([]utils.Drec, int) {
+
+	type mkey struct {
+		dob    uint16
+		sex    uint8
+		region uint8
+	}
+
+	groups := make(map[mkey][]int)
+	for i, r := range pool {
+		ky := mkey{r.DOB, r.Sex, r.Region}
+		groups[ky] = append(groups[ky], i)
+	}
+
+	bl := uint16(spec.BaselineDays)
+
+	// A potential control with its sampling key
+	type cand struct {
+		ix int
+		u  float64
+	}
+
+	var out []utils.Drec
+	var nshort int
+	for _, c := range pool {
+
+		if !c.Hf {
+			continue
+		}
+		t := c.HfDate
+
+		// The risk set at the case's heart failure date
+		var rs []cand
+		for _, j := range groups[mkey{c.DOB, c.Sex, c.Region}] {
+			r := &pool[j]
+			if r.ID == c.ID || r.CvrgStart+bl > t {
+				continue
+			}
+			if r.Event != utils.EventCensored && r.EventDate <= t {
+				// Heart failure or death on or before t
+				continue
+			}
+			if spec.FollowupEnd(r.CvrgStart, r.CvrgEnd) < t {
+				continue
+			}
+			rs = append(rs, cand{j, utils.SampleUniform(spec.Controls.Seed^c.ID, r.ID)})
+		}
+		sort.Slice(rs, func(i, j int) bool { return rs[i].u < rs[j].u })
+		if len(rs) > spec.NCCControls {
+			rs = rs[0:spec.NCCControls]
+		} else if len(rs) < spec.NCCControls {
+			nshort++
+		}
+
+		cr := c
+		cr.MatchSet = c.ID
+		cr.SetCase = true
+		cr.SetDate = t
+		out = append(out, cr)
+
+		for _, x := range rs {
+			r := pool[x.ix]
+			r.MatchSet = c.ID
+			r.SetDate = t
+			out = append(out, r)
+		}
+	}
+
+	return out, nshort
+}
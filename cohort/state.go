@@ -0,0 +1,119 @@
+package cohort
+
+import (
+	"github.com/brookluers/hfp/utils"
+)
+
+// State is what is known about a subject from the claims read so
+// far.  Builder.Scan adds claims to the state, and Builder.Record
+// builds the subject's record from it.  Keeping the states of a run
+// allows the cohort to be refreshed when a new year of claims
+// arrives, by scanning only the new claims.
+//
+// The baseline fields are collected for the baseline window starting
+// on D0.  If the baseline window moves to a date before the new
+// claims (when the new year extends an earlier span of eligibility
+// beyond the one used so far), the claims in the new window are no
+// longer available and the state is marked Stale.
+type State struct {
+
+	// Enrollee id
+	ID uint64
+
+	// Year of birth, sex, region and relationship to the employee,
+	// from the first enrollment row
+	DOB    uint16
+	Sex    uint8
+	Region uint8
+	Emprel uint8
+
+	// Year and days of enrollment, one per row of the A table
+	Years   []uint16
+	Memdays []uint16
+
+	// Start of the baseline window to which the baseline fields
+	// refer, 0 if the subject has no eligible year
+	D0 uint16
+
+	// The baseline window moved into claims that were read earlier,
+	// a full run is needed to build the record
+	Stale bool
+
+	// All heart failure diagnoses
+	HFDx []utils.HFDx
+
+	// Date of death (0 if none), and the dates of inpatient
+	// discharges
+	Death      uint16
+	Discharges []uint16
+
+	// Elixhauser categories seen in the baseline window, and where
+	// they were seen (Dx flags)
+	Elix    []bool
+	ElixSrc []uint8
+
+	// Charlson categories and drug therapeutic groups seen in the
+	// baseline window
+	Charlson []bool
+	Thrgrp   []bool
+
+	// Procedure groups seen in the baseline window, bit j set if
+	// seen in the j^th table
+	Procgrp []uint8
+
+	// Drug fills in the baseline window, and whether the days supply
+	// is available
+	Fills      []Fill
+	HasDaysupp bool
+
+	// Dates of outpatient and emergency department visits, and
+	// inpatient admission and discharge dates, in the baseline
+	// window
+	OutDays map[uint16]bool
+	EDDays  map[uint16]bool
+	Admits  map[uint16]uint16
+
+	// Date each Elixhauser category and drug group is first seen on
+	// or after D0, used for intervals
+	ElixFirst   []uint16
+	ThrgrpFirst []uint16
+}
+
+// Fill is one drug fill.
+type Fill struct {
+
+	// Therapeutic group, starting from 0
+	Group uint8
+
+	// Date of the fill, and days supply (0 if not available)
+	Date uint16
+	Days uint16
+}
+
+// resetBaseline clears the baseline fields, for a baseline window
+// starting on d0.
+func (st *State) resetBaseline(d0 uint16, nelix, ncharl int) {
+	st.D0 = d0
+	st.Elix = make([]bool, nelix)
+	st.ElixSrc = make([]uint8, nelix)
+	st.Charlson = make([]bool, ncharl)
+	st.Thrgrp = make([]bool, utils.NumThrgrp)
+	st.Procgrp = make([]uint8, utils.NumProcgrp)
+	st.Fills = nil
+	st.OutDays = make(map[uint16]bool)
+	st.EDDays = make(map[uint16]bool)
+	st.Admits = make(map[uint16]uint16)
+	st.ElixFirst = make([]uint16, nelix)
+	st.ThrgrpFirst = make([]uint16, utils.NumThrgrp)
+}
+
+// SubjectID returns the enrollee id of the subject with the given
+// claims, 0 if there are no claims.
+func SubjectID(tabs []Claims) uint64 {
+	for _, tb := range tabs {
+		if tb != nil {
+			return tb.Get("Enrolid").([]uint64)[0]
+		}
+	}
+	return 0
+}
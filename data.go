@@ -7,7 +7,6 @@ package main
 import (
 	"compress/gzip"
 	"encoding/binary"
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,7 +15,9 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"unicode"
 
+	"github.com/brookluers/gocols/config"
 	"github.com/brookluers/hfp/utils"
 )
 
@@ -30,58 +31,133 @@ type xws struct {
 	zw io.WriteCloser
 
 	xt func(*utils.Drec) float64
+
+	// The first error, after which nothing more is written
+	err error
+
+	closed bool
 }
 
+// All columns that have been set up, see closeAll
+var allxws []*xws
+
 // Init sets up an xws value to write t the given file, using values extracted from the
 // data record using the given extractor function.
 func (xw *xws) Init(fname string, f func(*utils.Drec) float64) {
 
-	var err error
-	xw.fw, err = os.Create(path.Join("data", fmt.Sprintf("%s.bin.gz", fname)))
-	if err != nil {
-		panic(err)
+	allxws = append(allxws, xw)
+	xw.xt = f
+
+	xw.fw, xw.err = os.Create(path.Join("data", fmt.Sprintf("%s.bin.gz", fname)))
+	if xw.err != nil {
+		xw.closed = true
+		return
 	}
 
 	xw.zw = gzip.NewWriter(xw.fw)
-	xw.xt = f
 }
 
 // Add extracts and writes one value from the record to the binary column file.
 func (xw *xws) Add(r *utils.Drec) {
-	err := binary.Write(xw.zw, binary.LittleEndian, xw.xt(r))
-	if err != nil {
-		panic(err)
+	if xw.err != nil {
+		return
+	}
+	xw.err = binary.Write(xw.zw, binary.LittleEndian, xw.xt(r))
+}
+
+// Close closes the io writers, and returns the first error from
+// writing the column.
+func (xw *xws) Close() error {
+	if xw.closed {
+		return xw.err
+	}
+	xw.closed = true
+	if err := xw.zw.Close(); err != nil && xw.err == nil { // order is important here
+		xw.err = err
+	}
+	if err := xw.fw.Close(); err != nil && xw.err == nil {
+		xw.err = err
 	}
+	return xw.err
 }
 
-// Close closes the io writers.
-func (xw *xws) Close() {
-	xw.zw.Close() // order is important here
-	xw.fw.Close()
+// closeAll closes all columns, and returns the first error.
+func closeAll() error {
+	var first error
+	for _, xw := range allxws {
+		if err := xw.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
-func maindata() {
+// factorCols sets up the columns for a factor variable: one column
+// holding the integer code, and one 0/1 indicator column for each
+// level, named using the level labels in the configuration.  If conf is
+// nil only the code column is written.
+func factorCols(name string, conf *config.Config, f func(*utils.Drec) uint8) []*xws {
 
-	// Set up for reading the gob.
-	f, err := os.Open("hfdat.gob.gz")
-	if err != nil {
-		panic(err)
+	x := new(xws)
+	x.Init(name, func(r *utils.Drec) float64 { return float64(f(r)) })
+	cols := []*xws{x}
+
+	// Make the labels usable as variable names
+	clean := func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
 	}
-	defer f.Close()
-	g, err := gzip.NewReader(f)
-	if err != nil {
-		panic(err)
+
+	var codes map[string]int
+	if conf != nil {
+		codes = config.GetFactorCodes(name, conf)
+	}
+	var labels []string
+	for k := range codes {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+
+	for _, k := range labels {
+		c := uint8(codes[k])
+		x := new(xws)
+		x.Init(fmt.Sprintf("%s_%s", name, strings.Map(clean, k)),
+			func(r *utils.Drec) float64 {
+				if f(r) == c {
+					return 1
+				}
+				return 0
+			},
+		)
+		cols = append(cols, x)
 	}
-	defer g.Close()
 
-	dec := gob.NewDecoder(g)
+	return cols
+}
 
-	// Elixhauser category names
-	var elxn []string
-	err = dec.Decode(&elxn)
+func maindata() error {
+
+	// The header describes how the cohort was built
+	cr, err := utils.OpenCohort("hfdat.gob.gz")
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer cr.Close()
+	hdr := cr.Header
+
+	elxn := hdr.Elix
+	spec := &hdr.Spec
+	bl := uint16(spec.BaselineDays)
+
+	// The current counting-process interval, nil if the records do
+	// not contain intervals.
+	var iv *utils.Interval
+
+	// The current record, before the covariates of the interval are
+	// substituted
+	var base *utils.Drec
 
 	// Set up for writing the Elixhauser values.
 	elxw := make([]*xws, len(elxn))
@@ -99,12 +175,64 @@ func maindata() {
 			},
 		)
 		elxw[i] = el
-		defer el.Close()
 	}
 
+	// Elixhauser categories seen in the primary position of an
+	// inpatient claim during the baseline window.  These are not
+	// updated in the counting-process intervals.  Files written
+	// before version 2 of the header do not record the position.
+	var elxpi []*xws
+	if hdr.Version >= 2 {
+		for i := range elxn {
+			ii := i
+			x := new(xws)
+			x.Init(fmt.Sprintf("ElixPI_%s", elxn[i]),
+				func(r *utils.Drec) float64 {
+					if base.ElixFlags(ii)&utils.DxPrimaryInpatient != 0 {
+						return 1
+					}
+					return 0
+				},
+			)
+			elxpi = append(elxpi, x)
+		}
+	} else {
+		fmt.Printf("hfdat.gob.gz has header version %d, ElixPI and HFPI not written\n", hdr.Version)
+	}
+
+	// Elixhauser summary scores
+	var esw []*xws
+	for _, es := range utils.ElixScores {
+		es := es
+		x := new(xws)
+		x.Init(es.Name, func(r *utils.Drec) float64 { return float64(es.Score(elxn, r.Elix)) })
+		esw = append(esw, x)
+	}
+
+	// Charlson categories and score
+	var chw []*xws
+	for i, c := range hdr.Charlson {
+		ii := i
+		x := new(xws)
+		x.Init(fmt.Sprintf("Charl_%s", c),
+			func(r *utils.Drec) float64 {
+				j := sort.SearchInts(r.Charlson, ii)
+				if j == len(r.Charlson) || r.Charlson[j] != ii {
+					return 0
+				}
+				return 1
+			},
+		)
+		chw = append(chw, x)
+	}
+	chs := new(xws)
+	chs.Init("CharlsonScore", func(r *utils.Drec) float64 { return float64(r.CharlScore) })
+	chw = append(chw, chs)
+
 	// Set up for writing the drug therapeutic group values
-	tgw := make([]*xws, 31)
-	for i := 0; i < 31; i++ {
+	ntg := len(hdr.Thrgrp)
+	tgw := make([]*xws, ntg)
+	for i := 0; i < ntg; i++ {
 		tg := new(xws)
 		name := fmt.Sprintf("TG_%02d", i)
 		ii := i
@@ -118,96 +246,373 @@ func maindata() {
 			},
 		)
 		tgw[i] = tg
-		defer tg.Close()
 	}
 
+	// Drug fills, days supply and proportion of days covered, for
+	// each therapeutic group
+	var rxw []*xws
+	for i := 0; i < ntg; i++ {
+		ii := i
+		fl := new(xws)
+		fl.Init(fmt.Sprintf("RxFills_%02d", i),
+			func(r *utils.Drec) float64 {
+				if r.RxFills == nil {
+					return 0
+				}
+				return float64(r.RxFills[ii])
+			},
+		)
+		ds := new(xws)
+		ds.Init(fmt.Sprintf("RxDays_%02d", i),
+			func(r *utils.Drec) float64 {
+				if r.RxDays == nil {
+					return 0
+				}
+				return float64(r.RxDays[ii])
+			},
+		)
+		pdc := new(xws)
+		pdc.Init(fmt.Sprintf("RxPDC_%02d", i),
+			func(r *utils.Drec) float64 {
+				if r.RxPDC == nil {
+					return 0
+				}
+				return r.RxPDC[ii]
+			},
+		)
+		rxw = append(rxw, fl, ds, pdc)
+	}
+
+	// Region and relationship to the employee, the codes are in the
+	// A table configuration
+	var aconf *config.Config
+	if dir := hdr.ConfigDir("A"); dir != "" {
+		aconf = config.GetConfig(dir)
+	} else {
+		fmt.Printf("No A table configuration, Region_* and Emprel_* indicators not written\n")
+	}
+	var fcw []*xws
+	fcw = append(fcw, factorCols("Region", aconf, func(r *utils.Drec) uint8 { return r.Region })...)
+	fcw = append(fcw, factorCols("Emprel", aconf, func(r *utils.Drec) uint8 { return r.Emprel })...)
+
+	// Health care utilization in the baseline window
+	var utw []*xws
+	for _, u := range []struct {
+		name string
+		f    func(*utils.Drec) float64
+	}{
+		{"OutVisits", func(r *utils.Drec) float64 { return float64(r.OutVisits) }},
+		{"EDVisits", func(r *utils.Drec) float64 { return float64(r.EDVisits) }},
+		{"InpAdmits", func(r *utils.Drec) float64 { return float64(r.InpAdmits) }},
+		{"InpDays", func(r *utils.Drec) float64 { return float64(r.InpDays) }},
+	} {
+		x := new(xws)
+		x.Init(u.name, u.f)
+		utw = append(utw, x)
+	}
+
+	id := new(xws)
+	id.Init("ID", func(r *utils.Drec) float64 { return float64(r.ID) })
+
 	hfdate := new(xws)
 	hfdate.Init("HFDate", func(r *utils.Drec) float64 { return float64(r.HfDate) })
-	defer hfdate.Close()
+
+	// Heart failure at the end of the row's interval, or during
+	// follow-up
+	event := func(r *utils.Drec) bool {
+		if iv != nil {
+			return iv.Event
+		}
+		return r.Hf
+	}
 
 	hf := new(xws)
 	hf.Init(
 		"HF",
 		func(r *utils.Drec) float64 {
-			if r.Hf {
+			if event(r) {
 				return 1
 			}
 			return 0
 		},
 	)
-	defer hf.Close()
+
+	// Heart failure established by a diagnosis in the primary
+	// position of an inpatient claim, and the Dx flags of the heart
+	// failure diagnoses
+	var hfpi []*xws
+	if hdr.Version >= 2 {
+		pi := new(xws)
+		pi.Init("HFPI",
+			func(r *utils.Drec) float64 {
+				if event(r) && r.HfSrc&utils.DxPrimaryInpatient != 0 {
+					return 1
+				}
+				return 0
+			},
+		)
+		hsrc := new(xws)
+		hsrc.Init("HFSrc", func(r *utils.Drec) float64 { return float64(r.HfSrc) })
+		hfpi = append(hfpi, pi, hsrc)
+	}
 
 	dob := new(xws)
 	dob.Init("DOB", func(r *utils.Drec) float64 { return float64(r.DOB) })
-	defer dob.Close()
 
 	cvrgstart := new(xws)
 	cvrgstart.Init("CvrgStart", func(r *utils.Drec) float64 { return float64(r.CvrgStart) })
-	defer cvrgstart.Close()
 
 	cvrgend := new(xws)
 	cvrgend.Init("CvrgEnd", func(r *utils.Drec) float64 { return float64(r.CvrgEnd) })
-	defer cvrgend.Close()
 
 	female := new(xws)
 	female.Init("Female", func(r *utils.Drec) float64 { return float64(r.Sex - 1) })
-	defer female.Close()
+
+	sprob := new(xws)
+	sprob.Init("SampProb", func(r *utils.Drec) float64 { return r.SampProb })
+
+	// Columns describing the sampling design
+	var dsgn []*xws
+	switch spec.Design {
+	case utils.DesignCaseCohort:
+		subc := new(xws)
+		subc.Init("SubCohort",
+			func(r *utils.Drec) float64 {
+				if r.SubCohort {
+					return 1
+				}
+				return 0
+			},
+		)
+		dsgn = append(dsgn, subc)
+	case utils.DesignNCC:
+		mset := new(xws)
+		mset.Init("MatchSet", func(r *utils.Drec) float64 { return float64(r.MatchSet) })
+		setcase := new(xws)
+		setcase.Init("SetCase",
+			func(r *utils.Drec) float64 {
+				if r.SetCase {
+					return 1
+				}
+				return 0
+			},
+		)
+		// All members of a matched set share the same value, the
+		// calendar date at which the set's case developed HF.
+		settime := new(xws)
+		settime.Init("SetTime", func(r *utils.Drec) float64 { return float64(r.SetDate) })
+		dsgn = append(dsgn, mset, setcase, settime)
+	}
+
+	// 0 (censored), 1 (heart failure) or 2 (death).  Only the last
+	// counting-process interval ends with the event, the others are
+	// censored.
+	evtype := new(xws)
+	evtype.Init("EventType",
+		func(r *utils.Drec) float64 {
+			if iv != nil && iv != &base.Intervals[len(base.Intervals)-1] {
+				return 0
+			}
+			return float64(r.Event)
+		},
+	)
+
+	// Start of each counting-process interval
+	var start *xws
+	if spec.Intervals != "" {
+		start = new(xws)
+		start.Init("Start", func(r *utils.Drec) float64 { return float64(iv.Start) })
+	}
 
 	tim := new(xws)
 	tim.Init("Time",
 		func(r *utils.Drec) float64 {
-			if r.Hf {
-				return float64(r.HfDate - r.CvrgStart - 365)
+			if iv != nil {
+				return float64(iv.Stop)
 			}
-			return float64(r.CvrgEnd - r.CvrgStart - 365)
+			// Time to heart failure, death or censoring
+			return float64(r.EventDate - r.CvrgStart - bl)
 		},
 	)
-	defer tim.Close()
 
-	nrec := 0
+	add := func(r *utils.Drec) {
+		id.Add(r)
+		hfdate.Add(r)
+		hf.Add(r)
+		dob.Add(r)
+		cvrgstart.Add(r)
+		cvrgend.Add(r)
+		tim.Add(r)
+		female.Add(r)
+		sprob.Add(r)
+		evtype.Add(r)
+
+		if start != nil {
+			start.Add(r)
+		}
+
+		for _, d := range dsgn {
+			d.Add(r)
+		}
+
+		for _, e := range elxw {
+			e.Add(r)
+		}
+
+		for _, t := range tgw {
+			t.Add(r)
+		}
+
+		for _, x := range rxw {
+			x.Add(r)
+		}
+
+		for _, x := range utw {
+			x.Add(r)
+		}
+
+		for _, x := range fcw {
+			x.Add(r)
+		}
+
+		for _, x := range chw {
+			x.Add(r)
+		}
+
+		for _, x := range esw {
+			x.Add(r)
+		}
+
+		for _, x := range elxpi {
+			x.Add(r)
+		}
+
+		for _, x := range hfpi {
+			x.Add(r)
+		}
+	}
+
+	// Subjects dropped by the DOB selection, and retained cases
+	dropped := make(map[uint64]bool)
+	cases := make(map[uint64]bool)
+
+	nrec, nrow := 0, 0
 	for {
 		var r utils.Drec
-		err := dec.Decode(&r)
+		err := cr.Next(&r)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			panic(err)
+			closeAll()
+			return fmt.Errorf("reading hfdat.gob.gz: %v", err)
 		}
 
 		// Needs to match selection in reduce.go.
 		if r.DOB > 1970 {
+			dropped[r.ID] = true
 			continue
 		}
 		nrec++
+		if r.Hf {
+			cases[r.ID] = true
+		}
 
-		hfdate.Add(&r)
-		hf.Add(&r)
-		dob.Add(&r)
-		cvrgstart.Add(&r)
-		cvrgend.Add(&r)
-		tim.Add(&r)
-		female.Add(&r)
-
-		for _, e := range elxw {
-			e.Add(&r)
+		base = &r
+		if spec.Intervals == "" {
+			add(&r)
+			nrow++
+			continue
 		}
 
-		for _, t := range tgw {
-			t.Add(&r)
+		// One row per counting-process interval, with the
+		// covariates for the interval.
+		for i := range r.Intervals {
+			iv = &r.Intervals[i]
+			ri := r
+			ri.Elix = iv.Elix
+			ri.Thrgrp = iv.Thrgrp
+			add(&ri)
+			nrow++
 		}
+		iv = nil
+	}
+
+	if err := closeAll(); err != nil {
+		return err
+	}
+	fmt.Printf("Processed %d records, wrote %d rows\n", nrec, nrow)
+
+	return attrition(len(dropped), len(cases), nrec)
+}
+
+// attrition adds the DOB selection to the attrition counts from
+// hfdat, writing data/attrition.json and data/attrition.txt.
+func attrition(ndrop, ncase, nrec int) error {
+
+	b, err := ioutil.ReadFile("attrition.json")
+	if os.IsNotExist(err) {
+		fmt.Printf("attrition.json not found, no attrition report written\n")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var rpt utils.AttritionReport
+	if err := json.Unmarshal(b, &rpt); err != nil {
+		return err
 	}
+	rpt.Total.ExcludeN("Born after 1970", ndrop)
+	rpt.Total.Cases = ncase
+	rpt.Total.Records = nrec
 
-	fmt.Printf("Processed %d records\n", nrec)
+	b, err = json.MarshalIndent(&rpt, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join("data", "attrition.json"), b, 0644); err != nil {
+		return err
+	}
+
+	tab := rpt.Total.Table()
+	if err := ioutil.WriteFile(path.Join("data", "attrition.txt"), []byte(tab), 0644); err != nil {
+		return err
+	}
+	fmt.Print(tab)
+	return nil
+}
+
+// clearData removes the columns written by an earlier run from the
+// data directory, so that a column which is not written for this
+// cohort (e.g. MatchSet, SubCohort, or Start) is not left behind.
+// The columns written by reduce are also removed, they must be
+// rebuilt for the new rows.
+func clearData() error {
+
+	fi, err := ioutil.ReadDir("data")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, f := range fi {
+		if strings.HasSuffix(f.Name(), ".bin.gz") {
+			if err := os.Remove(path.Join("data", f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // dtypes updates the dtype information in the data directory.
-func dtypes() {
+func dtypes() error {
 
 	dt := make(map[string]string)
 
 	fi, err := ioutil.ReadDir("data")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	for _, f := range fi {
@@ -220,17 +625,28 @@ func dtypes() {
 
 	out, err := os.Create("data/dtypes.json")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	enc := json.NewEncoder(out)
-	err = enc.Encode(&dt)
-	if err != nil {
-		panic(err)
+	if err := enc.Encode(&dt); err != nil {
+		out.Close()
+		return err
 	}
+	return out.Close()
 }
 
 func main() {
 
-	maindata()
-	dtypes()
+	if err := clearData(); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("data: %v\n", err))
+		os.Exit(1)
+	}
+	if err := maindata(); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("data: %v\n", err))
+		os.Exit(1)
+	}
+	if err := dtypes(); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("data: %v\n", err))
+		os.Exit(1)
+	}
 }
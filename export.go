@@ -0,0 +1,483 @@
+/*
+Export the records in hfdat.gob.gz to an Arrow IPC (Feather version 2)
+file, for use from R (arrow::read_feather) and Python
+(pyarrow.feather.read_table, pandas.read_feather).
+
+There is one row per record.  The variable-length fields of Drec are
+list columns, the dates are Arrow dates, Region and Emprel are
+dictionary encoded using the labels in the A table configuration,
+and the Elixhauser and Charlson categories are given by name.  The
+indicator and score columns written by data.go are added.  Each column
+carries a description in its metadata, and the header of hfdat.gob.gz
+is stored in the schema metadata.
+
+	export [-out hfdat.arrow] [-batch 100000] [-compress zstd]
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/brookluers/gocols/config"
+	"github.com/brookluers/hfp/utils"
+)
+
+// The dates in Drec are days since 1-1-1960, Arrow dates are days
+// since 1-1-1970.
+const epoch1970 = 3653
+
+var (
+	mem = memory.NewGoAllocator()
+
+	// The header of hfdat.gob.gz
+	hdr *utils.Header
+
+	// The first error from appending to a column, for the builders
+	// that can fail
+	colerr error
+)
+
+// column is one column of the output, add appends the value for a
+// record to the column's builder.
+type column struct {
+	field arrow.Field
+	add   func(b array.Builder, r *utils.Drec)
+}
+
+// field returns a field with the given description in its metadata.
+func field(name string, typ arrow.DataType, nullable bool, desc string) arrow.Field {
+	md := arrow.NewMetadata([]string{"description"}, []string{desc})
+	return arrow.Field{Name: name, Type: typ, Nullable: nullable, Metadata: md}
+}
+
+// date converts a Drec date to an Arrow date.
+func date(d uint16) arrow.Date32 {
+	return arrow.Date32(int32(d) - epoch1970)
+}
+
+// has returns true if the sorted array x contains j.
+func has(x []int, j int) bool {
+	i := sort.SearchInts(x, j)
+	return i < len(x) && x[i] == j
+}
+
+// appendNames appends the names of the categories with indices ix to a
+// list of strings.
+func appendNames(b array.Builder, names []string, ix []int) {
+	lb := b.(*array.ListBuilder)
+	lb.Append(true)
+	vb := lb.ValueBuilder().(*array.StringBuilder)
+	for _, j := range ix {
+		vb.Append(names[j])
+	}
+}
+
+// appendInts appends ix to a list of 32 bit integers.
+func appendInts(b array.Builder, ix []int) {
+	lb := b.(*array.ListBuilder)
+	lb.Append(true)
+	vb := lb.ValueBuilder().(*array.Int32Builder)
+	for _, j := range ix {
+		vb.Append(int32(j))
+	}
+}
+
+// factorCol returns a dictionary encoded column for a factor variable,
+// labeled using the factor codes in the configuration.  Codes with no
+// label are null.  If conf is nil the column holds the codes.
+func factorCol(name string, conf *config.Config, desc string, f func(*utils.Drec) uint8) column {
+
+	if conf == nil {
+		return column{field(name, arrow.PrimitiveTypes.Uint8, false, desc+" (code, no labels available)"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint8Builder).Append(f(r)) }}
+	}
+
+	codes := config.GetFactorCodes(name, conf)
+	labels := make(map[uint8]string)
+	var sl []string
+	for k, v := range codes {
+		labels[uint8(v)] = k
+		sl = append(sl, k)
+	}
+	sort.Strings(sl)
+
+	// All labels are inserted into the dictionary of each batch, so
+	// the dictionary is the same for every batch, as required by the
+	// IPC file format.
+	sb := array.NewStringBuilder(mem)
+	sb.AppendValues(sl, nil)
+	dict := sb.NewStringArray()
+
+	typ := &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Uint8, ValueType: arrow.BinaryTypes.String}
+	return column{
+		field(name, typ, true, desc),
+		func(b array.Builder, r *utils.Drec) {
+			db := b.(*array.BinaryDictionaryBuilder)
+			if db.Len() == 0 {
+				if err := db.InsertStringDictValues(dict); err != nil {
+					colerr = fmt.Errorf("column %s: %v", name, err)
+					return
+				}
+			}
+			lab, ok := labels[f(r)]
+			if !ok {
+				db.AppendNull()
+				return
+			}
+			if err := db.AppendString(lab); err != nil {
+				colerr = fmt.Errorf("column %s: %v", name, err)
+			}
+		},
+	}
+}
+
+// columns returns the columns of the output file.
+func columns() []column {
+
+	spec := &hdr.Spec
+	bl := uint16(spec.BaselineDays)
+	elxn := hdr.Elix
+	chn := hdr.Charlson
+	var aconf *config.Config
+	if dir := hdr.ConfigDir("A"); dir != "" {
+		aconf = config.GetConfig(dir)
+	}
+
+	strList := arrow.ListOf(arrow.BinaryTypes.String)
+	intList := arrow.ListOf(arrow.PrimitiveTypes.Int32)
+
+	idesc := "Enrollee id"
+	if hdr.PseudoID {
+		idesc = "Keyed pseudonym of the enrollee id"
+	}
+
+	cols := []column{
+		{field("ID", arrow.PrimitiveTypes.Uint64, false, idesc),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint64Builder).Append(r.ID) }},
+		{field("Hf", arrow.FixedWidthTypes.Boolean, false, "Heart failure ("+hdr.Outcome+")"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.BooleanBuilder).Append(r.Hf) }},
+		{field("HfDate", arrow.FixedWidthTypes.Date32, true, "Date of the first heart failure, null if none"),
+			func(b array.Builder, r *utils.Drec) {
+				if !r.Hf {
+					b.AppendNull()
+					return
+				}
+				b.(*array.Date32Builder).Append(date(r.HfDate))
+			}},
+		{field("HfSrc", arrow.PrimitiveTypes.Uint8, false, "Where the heart failure diagnoses were seen: bits 1 primary, 2 inpatient, 4 outpatient, 8 facility, 16 primary inpatient"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint8Builder).Append(r.HfSrc) }},
+		{field("Event", arrow.PrimitiveTypes.Uint8, false, "Event ending follow-up: 0 censored, 1 heart failure, 2 death"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint8Builder).Append(r.Event) }},
+		{field("EventDate", arrow.FixedWidthTypes.Date32, false, "Date of the event, or of censoring"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Date32Builder).Append(date(r.EventDate)) }},
+		{field("Time", arrow.PrimitiveTypes.Int32, false, "Days from the end of the baseline window to the event or censoring"),
+			func(b array.Builder, r *utils.Drec) {
+				b.(*array.Int32Builder).Append(int32(r.EventDate) - int32(r.CvrgStart) - int32(bl))
+			}},
+		{field("CvrgStart", arrow.FixedWidthTypes.Date32, false, "First date of coverage"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Date32Builder).Append(date(r.CvrgStart)) }},
+		{field("CvrgEnd", arrow.FixedWidthTypes.Date32, false, "Last date of coverage"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Date32Builder).Append(date(r.CvrgEnd)) }},
+		{field("DOB", arrow.PrimitiveTypes.Uint16, false, "Year of birth"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint16Builder).Append(r.DOB) }},
+		{field("Sex", arrow.PrimitiveTypes.Uint8, false, "Sex: 1 male, 2 female"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint8Builder).Append(r.Sex) }},
+		factorCol("Region", aconf, "Geographic region", func(r *utils.Drec) uint8 { return r.Region }),
+		factorCol("Emprel", aconf, "Relationship to the employee", func(r *utils.Drec) uint8 { return r.Emprel }),
+		{field("SampProb", arrow.PrimitiveTypes.Float64, false, "Probability of inclusion in the sample"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Float64Builder).Append(r.SampProb) }},
+		{field("SubCohort", arrow.FixedWidthTypes.Boolean, false, "Member of the subcohort (casecohort design)"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.BooleanBuilder).Append(r.SubCohort) }},
+		{field("MatchSet", arrow.PrimitiveTypes.Uint64, true, "Matched set, the ID of the set's case (ncc design)"),
+			func(b array.Builder, r *utils.Drec) {
+				if r.MatchSet == 0 {
+					b.AppendNull()
+					return
+				}
+				b.(*array.Uint64Builder).Append(r.MatchSet)
+			}},
+		{field("SetCase", arrow.FixedWidthTypes.Boolean, false, "The record is the case of its matched set (ncc design)"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.BooleanBuilder).Append(r.SetCase) }},
+		{field("SetDate", arrow.FixedWidthTypes.Date32, true, "Date of heart failure of the set's case (ncc design)"),
+			func(b array.Builder, r *utils.Drec) {
+				if r.MatchSet == 0 {
+					b.AppendNull()
+					return
+				}
+				b.(*array.Date32Builder).Append(date(r.SetDate))
+			}},
+		{field("Elix", strList, false, "Elixhauser categories"),
+			func(b array.Builder, r *utils.Drec) { appendNames(b, elxn, r.Elix) }},
+		{field("ElixSrc", arrow.ListOf(arrow.PrimitiveTypes.Uint8), false, "Where each category in Elix was seen, bits as in HfSrc"),
+			func(b array.Builder, r *utils.Drec) {
+				lb := b.(*array.ListBuilder)
+				lb.Append(true)
+				lb.ValueBuilder().(*array.Uint8Builder).AppendValues(r.ElixSrc, nil)
+			}},
+		{field("Charlson", strList, false, "Charlson categories in the baseline window"),
+			func(b array.Builder, r *utils.Drec) { appendNames(b, chn, r.Charlson) }},
+		{field("CharlsonScore", arrow.PrimitiveTypes.Uint8, false, "Charlson score"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint8Builder).Append(r.CharlScore) }},
+		{field("Thrgrp", intList, false, "Drug therapeutic groups"),
+			func(b array.Builder, r *utils.Drec) { appendInts(b, r.Thrgrp) }},
+	}
+
+	// Drug fills, days supply and proportion of days covered, indexed
+	// by therapeutic group, null if not available
+	cols = append(cols,
+		column{field("RxFills", arrow.ListOf(arrow.PrimitiveTypes.Uint16), true, "Fills in the baseline window, by therapeutic group"),
+			func(b array.Builder, r *utils.Drec) {
+				lb := b.(*array.ListBuilder)
+				if r.RxFills == nil {
+					lb.AppendNull()
+					return
+				}
+				lb.Append(true)
+				lb.ValueBuilder().(*array.Uint16Builder).AppendValues(r.RxFills, nil)
+			}},
+		column{field("RxDays", arrow.ListOf(arrow.PrimitiveTypes.Uint16), true, "Days supply in the baseline window, by therapeutic group"),
+			func(b array.Builder, r *utils.Drec) {
+				lb := b.(*array.ListBuilder)
+				if r.RxDays == nil {
+					lb.AppendNull()
+					return
+				}
+				lb.Append(true)
+				lb.ValueBuilder().(*array.Uint16Builder).AppendValues(r.RxDays, nil)
+			}},
+		column{field("RxPDC", arrow.ListOf(arrow.PrimitiveTypes.Float64), true, "Proportion of days covered in the baseline window, by therapeutic group"),
+			func(b array.Builder, r *utils.Drec) {
+				lb := b.(*array.ListBuilder)
+				if r.RxPDC == nil {
+					lb.AppendNull()
+					return
+				}
+				lb.Append(true)
+				lb.ValueBuilder().(*array.Float64Builder).AppendValues(r.RxPDC, nil)
+			}},
+		column{field("Procgrp", intList, false, "Procedure groups"),
+			func(b array.Builder, r *utils.Drec) { appendInts(b, r.Procgrp) }},
+		column{field("ProcSrc", arrow.ListOf(arrow.PrimitiveTypes.Uint8), false, "Tables in which each procedure group was seen, bit j for the j-th table"),
+			func(b array.Builder, r *utils.Drec) {
+				lb := b.(*array.ListBuilder)
+				lb.Append(true)
+				lb.ValueBuilder().(*array.Uint8Builder).AppendValues(r.ProcSrc, nil)
+			}},
+	)
+
+	// Health care utilization in the baseline window
+	for _, u := range []struct {
+		name string
+		desc string
+		f    func(*utils.Drec) uint16
+	}{
+		{"OutVisits", "Days with an outpatient visit", func(r *utils.Drec) uint16 { return r.OutVisits }},
+		{"EDVisits", "Days with an emergency department visit", func(r *utils.Drec) uint16 { return r.EDVisits }},
+		{"InpAdmits", "Inpatient admissions", func(r *utils.Drec) uint16 { return r.InpAdmits }},
+		{"InpDays", "Length of stay of the inpatient admissions", func(r *utils.Drec) uint16 { return r.InpDays }},
+	} {
+		f := u.f
+		cols = append(cols, column{field(u.name, arrow.PrimitiveTypes.Uint16, false, u.desc+" in the baseline window"),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Uint16Builder).Append(f(r)) }})
+	}
+
+	// Counting-process intervals
+	ivtype := arrow.StructOf(
+		field("Start", arrow.PrimitiveTypes.Uint16, false, "Start of the interval, days since the end of the baseline window"),
+		field("Stop", arrow.PrimitiveTypes.Uint16, false, "End of the interval, days since the end of the baseline window"),
+		field("Event", arrow.FixedWidthTypes.Boolean, false, "Heart failure at the end of the interval"),
+		field("Elix", strList, false, "Elixhauser categories seen before the start of the interval"),
+		field("Thrgrp", intList, false, "Drug therapeutic groups seen before the start of the interval"),
+	)
+	cols = append(cols, column{field("Intervals", arrow.ListOf(ivtype), false, "Counting-process intervals, empty unless the cohort specification requests intervals"),
+		func(b array.Builder, r *utils.Drec) {
+			lb := b.(*array.ListBuilder)
+			lb.Append(true)
+			sb := lb.ValueBuilder().(*array.StructBuilder)
+			for _, iv := range r.Intervals {
+				sb.Append(true)
+				sb.FieldBuilder(0).(*array.Uint16Builder).Append(iv.Start)
+				sb.FieldBuilder(1).(*array.Uint16Builder).Append(iv.Stop)
+				sb.FieldBuilder(2).(*array.BooleanBuilder).Append(iv.Event)
+				appendNames(sb.FieldBuilder(3), elxn, iv.Elix)
+				appendInts(sb.FieldBuilder(4), iv.Thrgrp)
+			}
+		}})
+
+	// Derived columns, as written by data.go
+	for i, c := range elxn {
+		ii := i
+		cols = append(cols, column{field("Elix_"+c, arrow.FixedWidthTypes.Boolean, false, "Elixhauser category "+c),
+			func(b array.Builder, r *utils.Drec) { b.(*array.BooleanBuilder).Append(has(r.Elix, ii)) }})
+	}
+	for i, c := range elxn {
+		ii := i
+		cols = append(cols, column{field("ElixPI_"+c, arrow.FixedWidthTypes.Boolean, false, "Elixhauser category "+c+" in the primary position of an inpatient claim"),
+			func(b array.Builder, r *utils.Drec) {
+				b.(*array.BooleanBuilder).Append(r.ElixFlags(ii)&utils.DxPrimaryInpatient != 0)
+			}})
+	}
+	for _, es := range utils.ElixScores {
+		es := es
+		cols = append(cols, column{field(es.Name, arrow.PrimitiveTypes.Int16, false, "Elixhauser score "+es.Name),
+			func(b array.Builder, r *utils.Drec) { b.(*array.Int16Builder).Append(int16(es.Score(elxn, r.Elix))) }})
+	}
+	for i, c := range chn {
+		ii := i
+		cols = append(cols, column{field("Charl_"+c, arrow.FixedWidthTypes.Boolean, false, "Charlson category "+c),
+			func(b array.Builder, r *utils.Drec) { b.(*array.BooleanBuilder).Append(has(r.Charlson, ii)) }})
+	}
+
+	return cols
+}
+
+// metadata returns the schema metadata, describing how the cohort was
+// built.
+func metadata() (arrow.Metadata, error) {
+
+	sp, err := json.Marshal(&hdr.Spec)
+	if err != nil {
+		return arrow.Metadata{}, err
+	}
+	cs, err := json.Marshal(hdr.CodeSets)
+	if err != nil {
+		return arrow.Metadata{}, err
+	}
+
+	return arrow.MetadataFrom(map[string]string{
+		"hfp.version":   fmt.Sprintf("%d", hdr.Version),
+		"hfp.created":   hdr.Created,
+		"hfp.codesets":  string(cs),
+		"hfp.configs":   strings.Join(hdr.Configs, ","),
+		"hfp.outcome":   hdr.Outcome,
+		"hfp.pseudo_id": fmt.Sprintf("%t", hdr.PseudoID),
+		"hfp.elix":      strings.Join(hdr.Elix, ","),
+		"hfp.charlson":  strings.Join(hdr.Charlson, ","),
+		"hfp.spec":      string(sp),
+	}), nil
+}
+
+func export(outname string, batch int, compress string) error {
+
+	cr, err := utils.OpenCohort("hfdat.gob.gz")
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	hdr = cr.Header
+
+	cols := columns()
+	var fields []arrow.Field
+	for _, c := range cols {
+		fields = append(fields, c.field)
+	}
+	md, err := metadata()
+	if err != nil {
+		return err
+	}
+	schema := arrow.NewSchema(fields, &md)
+
+	opts := []ipc.Option{ipc.WithSchema(schema), ipc.WithAllocator(mem)}
+	switch compress {
+	case "zstd":
+		opts = append(opts, ipc.WithZstd())
+	case "lz4":
+		opts = append(opts, ipc.WithLZ4())
+	case "none":
+	default:
+		return fmt.Errorf("unknown compression '%s'", compress)
+	}
+
+	out, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := ipc.NewFileWriter(out, opts...)
+	if err != nil {
+		return err
+	}
+
+	rb := array.NewRecordBuilder(mem, schema)
+	defer rb.Release()
+
+	// Write the records accumulated in rb as one record batch
+	var nrow int
+	flush := func() error {
+		if nrow == 0 {
+			return nil
+		}
+		rec := rb.NewRecord()
+		defer rec.Release()
+		nrow = 0
+		return w.Write(rec)
+	}
+
+	nrec := 0
+	for {
+		var r utils.Drec
+		err := cr.Next(&r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading hfdat.gob.gz: %v", err)
+		}
+
+		for i, c := range cols {
+			c.add(rb.Field(i), &r)
+		}
+		if colerr != nil {
+			return colerr
+		}
+		nrow++
+		nrec++
+
+		if nrow == batch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d records to %s\n", nrec, outname)
+
+	return nil
+}
+
+func main() {
+
+	outname := flag.String("out", "hfdat.arrow", "Output file")
+	batch := flag.Int("batch", 100000, "Number of records in each record batch")
+	compress := flag.String("compress", "zstd", "Compression of the record batches: zstd, lz4 or none")
+	flag.Parse()
+
+	if *batch < 1 {
+		os.Stderr.WriteString("export: -batch must be positive\n")
+		os.Exit(1)
+	}
+
+	if err := export(*outname, *batch, *compress); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("export: %v\n", err))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,470 @@
+/*
+Generate small synthetic MarketScan-style claims tables (A, O, S, I,
+F, D) in the bucketed column layout read by hfdat, so that the
+pipeline can be run without the real data.
+
+Each table is written to its own directory, with a gocols
+configuration (conf.json), the factor codes (Codes/<variable>.json)
+and the bucketed columns at config.BucketPath.  The cohort
+specification (cohort.json) and the Elixhauser code files
+(elix9.json, elix10.json) are written to the output directory, so
+hfdat can be run there:
+
+	gendat -out synth
+	cd synth && hfdat -spec cohort.json
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/brookluers/gocols/config"
+	"github.com/brookluers/hfp/utils"
+)
+
+// comorb is a comorbidity with one representative ICD-9 and ICD-10
+// code.
+type comorb struct {
+	cat   string
+	icd9  string
+	icd10 string
+}
+
+var (
+	// Heart failure codes
+	hfcodes = []comorb{
+		{"CHF", "4280", "I509"},
+		{"CHF", "42820", "I110"},
+	}
+
+	// Other Elixhauser categories, using the AHRQ abbreviations
+	comorbs = []comorb{
+		{"DM", "25000", "E119"},
+		{"DMCX", "25040", "E1122"},
+		{"HTN", "4019", "I10"},
+		{"HTNCX", "40390", "I129"},
+		{"CHRNLUNG", "496", "J449"},
+		{"RENLFAIL", "5859", "N189"},
+		{"TUMOR", "1530", "C189"},
+		{"METS", "1970", "C780"},
+		{"DEPRESS", "311", "F329"},
+		{"OBESE", "27800", "E669"},
+		{"VALVE", "4240", "I340"},
+		{"LIVER", "5715", "K746"},
+	}
+
+	// Codes used for routine visits
+	routine = []comorb{
+		{"", "V700", "Z0000"},
+		{"", "4659", "J069"},
+		{"", "7245", "M545"},
+	}
+
+	// Data types of the columns
+	dtypes = map[string]string{
+		"Enrolid": "uint64",
+		"Year":    "uint16",
+		"Memdays": "uint16",
+		"Dobyr":   "uint16",
+		"Region":  "uint8",
+		"Emprel":  "uint8",
+		"Sex":     "uint8",
+		"Svcdate": "uint16",
+		"Admdate": "uint16",
+		"Disdate": "uint16",
+		"Dstatus": "uint8",
+		"Procgrp": "uint16",
+		"Stdplac": "uint8",
+		"Thergrp": "uint8",
+		"Daysupp": "uint16",
+		"Ndcnum":  "uint64",
+	}
+
+	// Factor codes for the Dx variables, shared by all tables
+	dxcodes map[string]int
+
+	// Flag values
+	nsubj     int
+	nbucket   int
+	firstYear int
+	lastYear  int
+	hfRate    float64
+	cmbPrev   float64
+	deathRate float64
+	outdir    string
+	spec      *utils.CohortSpec
+	rng       *rand.Rand
+)
+
+// edays returns the elapsed days from 1-1-1960 to the start of the
+// year, as in hfdat.
+func edays(year int) uint16 {
+	return uint16(365.25 * (float64(year) - 1960))
+}
+
+// dxcode returns the factor code of the comorbidity on the given date.
+func dxcode(c comorb, date uint16) uint64 {
+	if date >= utils.ICD10Start {
+		return uint64(dxcodes[c.icd10])
+	}
+	return uint64(dxcodes[c.icd9])
+}
+
+// table holds the rows of one table for one bucket.
+type table struct {
+	spec *utils.TableSpec
+	rows []map[string]uint64
+}
+
+// add appends a row to the table, variables not in the row are zero.
+func (t *table) add(row map[string]uint64) {
+	t.rows = append(t.rows, row)
+}
+
+// write writes the columns of the table for bucket k.
+func (t *table) write(k int) {
+
+	// Rows are sorted by Enrolid, then by date
+	dv := t.spec.DateVar
+	sort.SliceStable(t.rows, func(i, j int) bool {
+		a, b := t.rows[i], t.rows[j]
+		if a["Enrolid"] != b["Enrolid"] {
+			return a["Enrolid"] < b["Enrolid"]
+		}
+		return a[dv] < b[dv]
+	})
+
+	bp := config.BucketPath(k, t.spec.Dir)
+	if err := os.MkdirAll(bp, 0755); err != nil {
+		panic(err)
+	}
+
+	dt := make(map[string]string)
+	for _, v := range t.spec.Columns {
+
+		dtype := dtypes[v]
+		if strings.HasPrefix(v, "Dx") {
+			dtype = "uint64"
+		}
+		dt[v] = dtype
+
+		var x interface{}
+		switch dtype {
+		case "uint8":
+			u := make([]uint8, len(t.rows))
+			for i, r := range t.rows {
+				u[i] = uint8(r[v])
+			}
+			x = u
+		case "uint16":
+			u := make([]uint16, len(t.rows))
+			for i, r := range t.rows {
+				u[i] = uint16(r[v])
+			}
+			x = u
+		case "uint64":
+			u := make([]uint64, len(t.rows))
+			for i, r := range t.rows {
+				u[i] = r[v]
+			}
+			x = u
+		default:
+			panic(fmt.Sprintf("no data type for %s\n", v))
+		}
+
+		fid, err := os.Create(path.Join(bp, v+".bin.gz"))
+		if err != nil {
+			panic(err)
+		}
+		gid := gzip.NewWriter(fid)
+		if err := binary.Write(gid, binary.LittleEndian, x); err != nil {
+			panic(err)
+		}
+		gid.Close()
+		fid.Close()
+	}
+
+	writeJSON(path.Join(bp, "dtypes.json"), dt)
+}
+
+// writeJSON writes the value to a file in JSON format.
+func writeJSON(fname string, x interface{}) {
+	b, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(fname, b, 0644); err != nil {
+		panic(err)
+	}
+}
+
+// setupCodes assigns factor codes to all of the diagnosis codes.
+func setupCodes() {
+	dxcodes = make(map[string]int)
+	for _, cl := range [][]comorb{hfcodes, comorbs, routine} {
+		for _, c := range cl {
+			for _, x := range []string{c.icd9, c.icd10} {
+				if _, ok := dxcodes[x]; !ok {
+					dxcodes[x] = len(dxcodes) + 1
+				}
+			}
+		}
+	}
+}
+
+// setupConfig writes the gocols configuration and factor codes for
+// each table.
+func setupConfig() {
+
+	region := map[string]int{"Northeast": 1, "North Central": 2, "South": 3, "West": 4, "Unknown": 5}
+	emprel := map[string]int{"Employee": 1, "Spouse": 2, "Child/Other": 3}
+
+	for j := range spec.Tables {
+		t := &spec.Tables[j]
+		t.Dir = path.Join(outdir, t.Name)
+		if err := os.MkdirAll(path.Join(t.Dir, "Codes"), 0755); err != nil {
+			panic(err)
+		}
+
+		conf := &config.Config{
+			NumBuckets: uint32(nbucket),
+			TargetDir:  t.Dir,
+		}
+		writeJSON(path.Join(t.Dir, "conf.json"), conf)
+
+		writeJSON(path.Join(t.Dir, "Codes", "Dx.json"), dxcodes)
+		if t.Name == "A" {
+			writeJSON(path.Join(t.Dir, "Codes", "Region.json"), region)
+			writeJSON(path.Join(t.Dir, "Codes", "Emprel.json"), emprel)
+		}
+	}
+
+	writeJSON(path.Join(outdir, "cohort.json"), spec)
+}
+
+// writeElix writes the Elixhauser code files read by hfdat.
+func writeElix() {
+
+	elix9 := make(map[string][]string)
+	elix10 := make(map[string][]string)
+	for _, cl := range [][]comorb{hfcodes, comorbs} {
+		for _, c := range cl {
+			elix9[c.cat] = append(elix9[c.cat], c.icd9)
+			elix10[c.cat] = append(elix10[c.cat], c.icd10)
+		}
+	}
+
+	writeJSON(path.Join(outdir, "elix9.json"), elix9)
+	writeJSON(path.Join(outdir, "elix10.json"), elix10)
+}
+
+// subject generates the claims of one subject, adding them to the
+// tables, which are keyed by table name.
+func subject(id uint64, tabs map[string]*table) {
+
+	// Enrollment, with at least one full year
+	ny := 1 + rng.Intn(6)
+	y0 := firstYear + rng.Intn(lastYear-firstYear+1)
+	if y0+ny-1 > lastYear {
+		ny = lastYear - y0 + 1
+	}
+	d0, d1 := edays(y0), edays(y0+ny)
+
+	dobyr := uint64(1930 + rng.Intn(60))
+	sex := uint64(1 + rng.Intn(2))
+	region := uint64(1 + rng.Intn(5))
+	emprel := uint64(1 + rng.Intn(3))
+
+	// A random date in [a, b)
+	rdate := func(a, b uint16) uint16 {
+		return a + uint16(rng.Intn(int(b-a)))
+	}
+
+	// An outpatient visit, in the O table or, for ED visits, the F
+	// table, with a random procedure group
+	visit := func(date uint16, dx uint64, plac uint64) {
+		row := map[string]uint64{
+			"Enrolid": id,
+			"Svcdate": uint64(date),
+			"Procgrp": uint64(1 + rng.Intn(500)),
+			"Stdplac": plac,
+			"Dx1":     dx,
+		}
+		if plac == uint64(utils.EDPlace) {
+			tabs["F"].add(row)
+		} else {
+			tabs["O"].add(row)
+		}
+	}
+
+	// An inpatient admission, in the I and S tables
+	admit := func(date uint16, dx uint64, dstatus uint64) {
+		los := uint16(1 + rng.Intn(7))
+		tabs["I"].add(map[string]uint64{
+			"Enrolid": id,
+			"Admdate": uint64(date),
+			"Disdate": uint64(date + los),
+			"Dstatus": dstatus,
+			"Procgrp": uint64(1 + rng.Intn(500)),
+			"Dx1":     dx,
+		})
+		tabs["S"].add(map[string]uint64{
+			"Enrolid": id,
+			"Svcdate": uint64(date),
+			"Procgrp": uint64(1 + rng.Intn(500)),
+			"Stdplac": 21,
+			"Dx1":     dx,
+		})
+	}
+
+	// Comorbidities, each seen at an outpatient visit
+	ncmb := 0
+	for _, c := range comorbs {
+		if rng.Float64() < cmbPrev {
+			t := rdate(d0, d1)
+			visit(t, dxcode(c, t), 11)
+			ncmb++
+		}
+	}
+
+	// Heart failure, with a rate increasing with age and the number
+	// of comorbidities.  Onset is an inpatient admission with HF in
+	// the primary position, followed by outpatient visits.
+	age := float64(y0) - float64(dobyr)
+	rate := hfRate * math.Pow(1.5, float64(ncmb)) * math.Exp((age-50)/20)
+	if rng.Float64() < 1-math.Exp(-rate*float64(ny)) {
+		t := rdate(d0, d1)
+		hc := hfcodes[rng.Intn(len(hfcodes))]
+		admit(t, dxcode(hc, t), 1)
+		for v := t + 30; v < d1; v += 90 {
+			visit(v, dxcode(hc, v), 11)
+		}
+	}
+
+	// Routine outpatient and ED visits
+	for y := 0; y < ny; y++ {
+		for v := rng.Intn(6); v > 0; v-- {
+			t := rdate(edays(y0+y), edays(y0+y+1))
+			plac := uint64(11)
+			if rng.Float64() < 0.1 {
+				plac = uint64(utils.EDPlace)
+			}
+			visit(t, dxcode(routine[rng.Intn(len(routine))], t), plac)
+		}
+	}
+
+	// Drug fills, monthly for a few therapeutic groups
+	for g := rng.Intn(4); g > 0; g-- {
+		tg := uint64(1 + rng.Intn(31))
+		ndc := uint64(10000000000 + 1000*tg + uint64(rng.Intn(10)))
+		for t := rdate(d0, d1); t < d1; t += 30 {
+			tabs["D"].add(map[string]uint64{
+				"Enrolid": id,
+				"Svcdate": uint64(t),
+				"Thergrp": tg,
+				"Daysupp": 30,
+				"Ndcnum":  ndc,
+			})
+		}
+	}
+
+	// Death, at an inpatient admission, ending enrollment part way
+	// through the following year
+	var dy int
+	if y0+ny <= lastYear && rng.Float64() < 1-math.Exp(-deathRate*float64(ny)) {
+		t := edays(y0+ny) - uint16(1+rng.Intn(60))
+		admit(t, dxcode(routine[rng.Intn(len(routine))], t), 20)
+		dy = 1 + rng.Intn(150)
+	}
+
+	for y := 0; y < ny; y++ {
+		tabs["A"].add(map[string]uint64{
+			"Enrolid": id,
+			"Year":    uint64(y0 + y),
+			"Memdays": 365,
+			"Dobyr":   dobyr,
+			"Region":  region,
+			"Emprel":  emprel,
+			"Sex":     sex,
+		})
+	}
+	if dy > 0 {
+		tabs["A"].add(map[string]uint64{
+			"Enrolid": id,
+			"Year":    uint64(y0 + ny),
+			"Memdays": uint64(dy),
+			"Dobyr":   dobyr,
+			"Region":  region,
+			"Emprel":  emprel,
+			"Sex":     sex,
+		})
+	}
+}
+
+func main() {
+
+	var seed int64
+	flag.StringVar(&outdir, "out", "synth", "Output directory")
+	flag.IntVar(&nsubj, "n", 20000, "Number of subjects")
+	flag.IntVar(&nbucket, "buckets", 4, "Number of buckets")
+	flag.IntVar(&firstYear, "first", 2010, "First year of enrollment")
+	flag.IntVar(&lastYear, "last", 2017, "Last year of enrollment")
+	flag.Float64Var(&hfRate, "hf", 0.02, "Annual heart failure incidence at age 50 without comorbidities")
+	flag.Float64Var(&cmbPrev, "comorb", 0.1, "Prevalence of each comorbidity")
+	flag.Float64Var(&deathRate, "death", 0.01, "Annual probability of death")
+	flag.Int64Var(&seed, "seed", 1, "Random seed")
+	flag.Parse()
+
+	if lastYear < firstYear {
+		os.Stderr.WriteString("-last must not be before -first\n")
+		os.Exit(1)
+	}
+
+	var err error
+	outdir, err = filepath.Abs(outdir)
+	if err != nil {
+		panic(err)
+	}
+
+	rng = rand.New(rand.NewSource(seed))
+	spec = utils.DefaultSpec()
+
+	setupCodes()
+	setupConfig()
+	writeElix()
+
+	for k := 0; k < nbucket; k++ {
+
+		tabs := make(map[string]*table)
+		for j := range spec.Tables {
+			tabs[spec.Tables[j].Name] = &table{spec: &spec.Tables[j]}
+		}
+
+		for i := 0; i < nsubj; i++ {
+			id := uint64(1000000 + i)
+			if int(id%uint64(nbucket)) != k {
+				continue
+			}
+			subject(id, tabs)
+		}
+
+		for _, t := range tabs {
+			t.write(k)
+		}
+	}
+
+	fmt.Printf("Wrote %d subjects in %d buckets to %s\n", nsubj, nbucket, outdir)
+}
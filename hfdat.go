@@ -6,20 +6,25 @@ Also include a random sample of eligible people without heart failure.
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/gob"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/brookluers/dstream/dstream"
 	"github.com/brookluers/gocols/config"
+	"github.com/brookluers/hfp/cohort"
 	"github.com/brookluers/hfp/utils"
 )
 
@@ -27,56 +32,68 @@ const (
 	// Chunk size for reading raw data
 	csize = 100000
 
-	// Exclude a person for one year if they do not have this many
-	// days of coverage in the year
-	mincoverage = 360
-
 	// Process this number of buckets in parallel
 	concurrency = 100
 )
 
 var (
-	// Source file names (A, I, etc.)
-	dix []string
+	// The cohort definition
+	spec *utils.CohortSpec
 
 	// Map from ICD codes to our integer representation
 	dxcodes map[string]int
 
+	// Key used to pseudonymize enrollee ids, if nil the raw ids are
+	// written
+	idkey []byte
+
+	// The heart failure definition
+	hfdef *utils.CodeSet
+
 	// Int codes corresponding to heart faiure ICD codes
 	hfcodes []int
 
+	// The rule determining heart failure onset from the diagnoses
+	phen *utils.Phenotype
+
 	// Names of Elixhauser categories
 	elxcat []string
 
+	// Digests of the Elixhauser code files
+	elixsum []utils.CodeSetVersion
+
 	// Int codes corresponding to ICD codes for each Elixhauser category
 	elix [][]int
 
+	// Int codes corresponding to ICD-9 and ICD-10 codes for each
+	// Charlson category
+	charl   [][]int
+	charl10 [][]int
+
+	// Builds the record of each subject
+	builder *cohort.Builder
+
 	logger *log.Logger
 
-	oif io.WriteCloser
-	oig io.WriteCloser
+	// Directory holding the per-bucket shard files
+	sharddir string
 
-	rslt chan utils.Drec
-	sem  chan bool
+	// Shard directory of the run being refreshed, empty for a full
+	// run
+	prevdir string
 
-	// Configuration files
-	aconf, oconf, sconf, iconf, fconf, dconf *config.Config
+	// Revision of the cohort, see utils.Header
+	revision = 1
 
-	// Driectory paths to the configuration files
-	adir, odir, sdir, idir, fdir, ddir string
-)
+	// If true, the subject states are written to the shard directory
+	// so that the cohort can be refreshed
+	savestate bool
 
-// bcomp compresses a Boolean array into a list of indices where the
-// values are true.  For example, [true, false, true] becomes [0, 2].
-func bcomp(x []bool) []int {
-	var y []int
-	for i, v := range x {
-		if v {
-			y = append(y, i)
-		}
-	}
-	return y
-}
+	sem chan bool
+
+	// Configuration files, one for each source file
+	confs []*config.Config
+)
 
 // convertICDCodes takes a list of ICD9 codes in string form and maps
 // them to their corresponding integer codes.
@@ -93,49 +110,45 @@ func convertICDCodes(r []string) []int {
 	return i
 }
 
-// matchset returns true or false based on whether y is an element of
-// the sorted array x.
-func matchset(x []int, y int) bool {
-
-	j := sort.SearchInts(x, y)
-
-	if j == len(x) || x[j] != y {
-		return false
-	}
-
-	return true
-}
-
 // readRawElix loads and returns the Elixhauser ICD codes for either
-// version 9 or version 10.
-func readRawElix(ver int) map[string][]string {
+// version 9 or version 10.  The SHA-256 digest of the file is
+// recorded in elixsum.
+func readRawElix(ver int) (map[string][]string, error) {
 
 	fn := fmt.Sprintf("elix%d.json", ver)
-	fid, err := os.Open(fn)
+	b, err := ioutil.ReadFile(fn)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer fid.Close()
 
-	dec := json.NewDecoder(fid)
 	elx := make(map[string][]string)
-	err = dec.Decode(&elx)
-	if err != nil {
-		panic(err)
+	if err := json.Unmarshal(b, &elx); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
 	}
 
-	return elx
+	elixsum = append(elixsum, utils.CodeSetVersion{
+		Name:    fn,
+		Version: fmt.Sprintf("sha256:%x", sha256.Sum256(b)),
+	})
+
+	return elx, nil
 }
 
 // getElix returns an array of arrays containing sorted, distinct codes for each Elixhauser category,
 // and a list of names for the categories.
-func getElix() ([][]int, []string) {
+func getElix() ([][]int, []string, error) {
 
 	var elxcat []string
 
 	// The ICD9 and ICD10 codes for Elixhauser categories
-	elix9 := readRawElix(9)
-	elix10 := readRawElix(10)
+	elix9, err := readRawElix(9)
+	if err != nil {
+		return nil, nil, err
+	}
+	elix10, err := readRawElix(10)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Get the Elixhauser category names (assume Elix9 and Elix10 category
 	// names are the same).
@@ -152,75 +165,32 @@ func getElix() ([][]int, []string) {
 		var u []int
 		u = append(u, convertICDCodes(elix9[cat])...)
 		u = append(u, convertICDCodes(elix10[cat])...)
-
-		// Sort and remove duplicates
-		sort.Sort(sort.IntSlice(u))
-		j := 0
-		for i := range u {
-			if i == 0 || u[i] != u[i-1] {
-				u[j] = u[i]
-				j++
-			}
-		}
-		u = u[0:j]
-		elx = append(elx, u)
+		elx = append(elx, cohort.SortUniq(u))
 	}
 
-	return elx, elxcat
+	return elx, elxcat, nil
 }
 
-// edays takes a four digit year, and returns the elapsed days from 1-1-1960.
-func edays(year int) uint16 {
-	return uint16(365.25 * (float64(year) - 1960))
+// sortedIndex returns the position of s in the sorted array x, or -1
+// if it is not present.
+func sortedIndex(x []string, s string) int {
+	j := sort.SearchStrings(x, s)
+	if j == len(x) || x[j] != s {
+		return -1
+	}
+	return j
 }
 
-// setup Bucket returns an array of dstreams corresponding to
-// A, O, S, I, F and D tables.  Relevant columns are selected
+// setupBucket returns an array of dstreams corresponding to the
+// tables in the cohort specification.  Relevant columns are selected
 // from each table.
 func setupBucket(bk int) []dstream.Dstream {
 
 	var data []dstream.Dstream
 
-	for _, v := range []struct {
-		dirpath string
-		include []string
-	}{
-		{
-			// A tables
-			dirpath: adir,
-			include: []string{"Enrolid", "Year", "Memdays", "Dobyr", "Region", "Emprel", "Sex"},
-		},
-		{
-			// O tables
-			dirpath: odir,
-			include: []string{"Enrolid", "Svcdate", "Dx1", "Dx2", "Dx3", "Dx4"},
-		},
-		{
-			// S tables
-			dirpath: sdir,
-			include: []string{"Enrolid", "Svcdate", "Dx1", "Dx2"},
-		},
-		{
-			// I tables
-			dirpath: idir,
-			include: []string{"Enrolid", "Admdate", "Dx1", "Dx2", "Dx3", "Dx4", "Dx5",
-				"Dx6", "Dx7", "Dx8", "Dx9", "Dx10", "Dx11", "Dx12", "Dx13",
-				"Dx14", "Dx15"},
-		},
-		{
-			// F tables
-			dirpath: fdir,
-			include: []string{"Enrolid", "Svcdate", "Dx1", "Dx2", "Dx3", "Dx4", "Dx5",
-				"Dx6", "Dx7", "Dx8", "Dx9"},
-		},
-		{
-			// D tables
-			dirpath: ddir,
-			include: []string{"Enrolid", "Svcdate", "Thergrp"},
-		},
-	} {
-		bp := config.BucketPath(bk, v.dirpath)
-		da := dstream.NewBCols(bp, csize).Include(v.include).Done()
+	for _, v := range spec.Tables {
+		bp := config.BucketPath(bk, v.Dir)
+		da := dstream.NewBCols(bp, csize).Include(v.Columns).Done()
 		da = dstream.Segment(da, []string{"Enrolid"})
 		data = append(data, da)
 	}
@@ -228,297 +198,877 @@ func setupBucket(bk int) []dstream.Dstream {
 	return data
 }
 
-// getEligible finds the longest consecutive series of years during which the subject is eligible.
-func getEligible(ayear []uint16, amemdays []uint16) (int, int) {
+// shardName returns the path to the file holding the records for
+// bucket k.
+func shardName(k int) string {
+	return path.Join(sharddir, fmt.Sprintf("bucket_%04d.gob.gz", k))
+}
 
-	// Years with full coverage
-	ym := make(map[int]bool)
-	for k := range ayear {
-		if amemdays[k] >= mincoverage {
-			ym[int(ayear[k])] = true
-		}
-	}
+// stateName returns the path to the file in directory dir holding
+// the subject states for bucket k.
+func stateName(dir string, k int) string {
+	return path.Join(dir, fmt.Sprintf("state_%04d.gob.gz", k))
+}
+
+// markerName returns the path to the file marking bucket k as
+// complete.
+func markerName(k int) string {
+	return path.Join(sharddir, fmt.Sprintf("bucket_%04d.done", k))
+}
 
-	if len(ym) == 0 {
-		return -1, -1
+// bucketDone returns true if bucket k was completed by an earlier run.
+func bucketDone(k int) bool {
+	_, err := os.Stat(markerName(k))
+	return err == nil
+}
+
+// bucketMarker holds the counts for a completed bucket.
+type bucketMarker struct {
+	Attrition *utils.Attrition
+
+	// Changes to the cohort, only when refreshing
+	Diff *utils.RefreshDiff `json:",omitempty"`
+}
+
+// markDone records that bucket k is complete, writing the attrition
+// counts for the bucket to the marker.  The marker is written to a
+// temporary file and renamed so that it is never seen partially
+// written.
+func markDone(k int, mk *bucketMarker) error {
+	b, err := json.Marshal(mk)
+	if err != nil {
+		return err
+	}
+	tmp := markerName(k) + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
 	}
+	return os.Rename(tmp, markerName(k))
+}
 
-	year0, year1 := -1, -1
-	mxd := 0
-	for y := range ym {
-		yy := y + 1
-		for ym[yy] {
-			// advance until the year is missing
-			yy++
-		}
-		if yy-y > mxd {
-			mxd = yy - y
-			year0 = y
-			year1 = yy
-		}
+// readMarker returns the counts in the marker of bucket k.
+func readMarker(k int) (*bucketMarker, error) {
+	b, err := ioutil.ReadFile(markerName(k))
+	if err != nil {
+		return nil, err
+	}
+	mk := new(bucketMarker)
+	if err := json.Unmarshal(b, mk); err != nil {
+		return nil, fmt.Errorf("%s: %v", markerName(k), err)
 	}
+	if mk.Attrition == nil {
+		return nil, fmt.Errorf("%s: no attrition counts", markerName(k))
+	}
+	return mk, nil
+}
 
-	return year0, year1
+// stateReader reads the subject states of one bucket, written by an
+// earlier run.
+type stateReader struct {
+	fid *os.File
+	gid *gzip.Reader
+	dec *gob.Decoder
 }
 
-// dxPos returns the positions of all Dx variables in each of the tables.
-func dxPos(data []dstream.Dstream) [][]int {
+// openStates opens the subject states of bucket k in the shard
+// directory of the run being refreshed.
+func openStates(k int) (*stateReader, error) {
+	fn := stateName(prevdir, k)
+	fid, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		fid.Close()
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return &stateReader{fid, gid, gob.NewDecoder(gid)}, nil
+}
 
-	var dpx [][]int
-	for j := range dix {
-		vpos := dstream.VarPos(data[j])
-		var u []int
-		for k, v := range vpos {
-			if strings.HasPrefix(k, "Dx") {
-				u = append(u, v)
-			}
-		}
-		dpx = append(dpx, u)
+// next returns the next state, or nil after the last state.
+func (sr *stateReader) next() (*cohort.State, error) {
+	st := new(cohort.State)
+	err := sr.dec.Decode(st)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %v", sr.fid.Name(), err)
 	}
+	return st, nil
+}
 
-	return dpx
+func (sr *stateReader) close() {
+	sr.gid.Close()
+	sr.fid.Close()
 }
 
-func dobucket(k int) {
+// bucketResult is the outcome of processing one bucket.
+type bucketResult struct {
+	k   int
+	err error
+}
 
-	defer func() { <-sem }()
+// dobucket processes all subjects in bucket k, writing the retained
+// records to the shard file for the bucket, and with -save-state the
+// states of all subjects to the state file.  When refreshing, the states from the
+// earlier run are extended with the new claims.  The marker for the
+// bucket is only written if there are no errors.
+func dobucket(k int) (err error) {
+
+	// The dstream readers panic on corrupt data, report this as an
+	// error for the bucket.
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
 
 	logger.Printf("Starting bucket %d\n", k)
 
-	ha := crc32.NewIEEE()
+	fid, err := os.Create(shardName(k))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	gid := gzip.NewWriter(fid)
+	enc := gob.NewEncoder(gid)
+	nrec := 0
 
-	data := setupBucket(k)
-	adata := data[0]
+	closers := []io.Closer{gid, fid}
 
-	dpx := dxPos(data)
+	// The subject states, only kept if they are needed for a later
+	// refresh
+	var senc *gob.Encoder
+	if savestate {
+		sfid, err := os.Create(stateName(sharddir, k))
+		if err != nil {
+			return err
+		}
+		defer sfid.Close()
+		sgid := gzip.NewWriter(sfid)
+		senc = gob.NewEncoder(sgid)
+		closers = append(closers, sgid, sfid)
+	}
 
-	// Positions of the date variable in each file
-	datename := []string{"Year", "Svcdate", "Svcdate", "Admdate", "Svcdate", "Svcdate"}
+	// The states from the run being refreshed, sorted by id
+	var prev *stateReader
+	var diff *utils.RefreshDiff
+	if prevdir != "" {
+		prev, err = openStates(k)
+		if err != nil {
+			return err
+		}
+		defer prev.close()
+		diff = new(utils.RefreshDiff)
+	}
 
-	wk := dstream.NewJoin(data, []string{"Enrolid", "Enrolid", "Enrolid", "Enrolid",
-		"Enrolid", "Enrolid"})
+	// Eligible subjects, used to form the risk sets for the nested
+	// case-control design
+	var pool []utils.Drec
 
-	// Loop over subjects
-	for js := 0; wk.Next(); js++ {
+	data := setupBucket(k)
+	src := cohort.NewJoinSource(data)
+	tabs := make([]cohort.Claims, len(data))
 
-		if js%100000 == 0 {
-			logger.Printf("Bucket %d: %d", k, js)
+	steps := []string{utils.AttrNoEligible, utils.AttrOneYear, utils.AttrShortCoverage, utils.AttrPrevalent, utils.AttrNotSampled}
+	if prevdir != "" {
+		steps = append(steps[:3], append([]string{utils.AttrStale}, steps[3:]...)...)
+	}
+	att := utils.NewAttrition(steps...)
+
+	// process handles one subject, given the state from the run being
+	// refreshed (nil if none) and the new claims (nil if none).
+	process := func(old *cohort.State, tabs []cohort.Claims) error {
+
+		st := old
+		var orec *utils.Drec
+		if old == nil {
+			st = new(cohort.State)
+		} else {
+			orec, _ = builder.Record(old)
+		}
+		if tabs != nil {
+			builder.Scan(st, tabs)
+		}
+		if senc != nil {
+			if err := senc.Encode(st); err != nil {
+				return err
+			}
 		}
 
-		// Get the eligible years.
-		ayear := adata.Get("Year").([]uint16)
-		amemdays := adata.Get("Memdays").([]uint16)
-		year0, year1 := getEligible(ayear, amemdays)
-		if year0 == -1 || year1-year0 == 1 {
-			// Note enough coverage
-			continue
+		att.Subjects++
+		r, reason := builder.Record(st)
+		if diff != nil {
+			diff.Compare(orec, r, reason, old == nil)
+		}
+		if r == nil {
+			att.Exclude(reason)
+			return nil
 		}
 
-		// First/last day of coverage window
-		d0 := edays(year0)
-		d1 := edays(year1)
+		if r.Hf {
+			att.Cases++
+		}
 
-		aenrolid := adata.Get("Enrolid").([]uint64)
-		adobyr := adata.Get("Dobyr").([]uint16)
-		asex := adata.Get("Sex").([]uint8)
+		if spec.Design == utils.DesignNCC {
+			pool = append(pool, *r)
+			return nil
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		nrec++
+		return nil
+	}
 
-		// Heart failure status
-		var hf = false
-		var hfdate uint16
+	// The next state from the run being refreshed
+	var old *cohort.State
+	nextOld := func() (err error) {
+		if prev != nil {
+			old, err = prev.next()
+		}
+		return
+	}
+	if err := nextOld(); err != nil {
+		return err
+	}
 
-		elx := make([]bool, len(elix)) // Elixhauser categories
-		thg := make([]bool, 31)        // Therapeutic groups for drugs
-		pcx := make([]bool, 500)       // Procedure grops
+	// Loop over subjects with claims
+	for js := 0; src.Next(); js++ {
 
-		// Loop over tables
-		for j, vb := range dix {
+		if js%100000 == 0 {
+			logger.Printf("Bucket %d: %d", k, js)
+		}
 
-			// Skip files that contain no useful information
-			if vb == "A" || !wk.Status[j] {
-				continue
-			}
+		for j := range tabs {
+			tabs[j] = src.Table(j)
+		}
+		id := cohort.SubjectID(tabs)
 
-			// The time values
-			sd := data[j].Get(datename[j]).([]uint16)
-
-			// Drug information
-			if vb == "D" {
-				thr := data[j].Get("Thergrp").([]uint8)
-				for i, t := range thr {
-					if sd[i] >= d0 && sd[i] <= d0+365 && t > 0 && t <= 31 {
-						thg[t-1] = true
-					}
-				}
+		// Subjects from the earlier run with no new claims
+		for old != nil && old.ID < id {
+			if err := process(old, nil); err != nil {
+				return err
 			}
-
-			// Procgrp information
-			if vb == "O" {
-				pcg := data[j].Get("Procgrp").([]uint16)
-				for i, p := range pcg {
-					if sd[i] >= d0 && sd[i] <= d0+365 && p > 0 {
-						pcx[p-1] = true
-					}
-				}
+			if err := nextOld(); err != nil {
+				return err
 			}
+		}
 
-			// Loop over the Dx variables in each file
-			for _, k := range dpx[j] {
-
-				// Loop through time
-				for i, y := range data[j].GetPos(k).([]uint64) {
-
-					// Check for heart failure
-					if matchset(hfcodes, int(y)) {
-						if !hf {
-							// First observation of an HF code for this subject
-							hfdate = sd[i]
-						} else {
-							if sd[i] < hfdate {
-								// Earliest HF code for this subject
-								hfdate = sd[i]
-							}
-						}
-						hf = true
-					}
-
-					// Update Elixhauser for first year after entry.
-					if sd[i] >= d0 && sd[i] <= d0+365 {
-						for q, ex := range elix {
-							elx[q] = elx[q] || matchset(ex, int(y))
-						}
-					}
-				}
+		var ost *cohort.State
+		if old != nil && old.ID == id {
+			ost = old
+			if err := nextOld(); err != nil {
+				return err
 			}
 		}
-
-		// Heart failure within first year, exclude
-		if hf && (hfdate < d0+365) {
-			continue
+		if err := process(ost, tabs); err != nil {
+			return err
+		}
+	}
+	for old != nil {
+		if err := process(old, nil); err != nil {
+			return err
+		}
+		if err := nextOld(); err != nil {
+			return err
 		}
+	}
 
-		// Take a random subsample of non-cases
-		if !hf {
-			binary.Write(ha, binary.LittleEndian, aenrolid[0])
-			if ha.Sum32()%10 != 0 {
-				continue
+	if spec.Design == utils.DesignNCC {
+		// Subjects in the pool that are in no matched set are not
+		// sampled
+		sets, nshort := cohort.NCCSample(spec, pool)
+		if nshort > 0 {
+			logger.Printf("%d cases have fewer than %d matched controls\n", nshort, spec.NCCControls)
+		}
+		insets := make(map[uint64]bool)
+		for i := range sets {
+			insets[sets[i].ID] = true
+			if err := enc.Encode(&sets[i]); err != nil {
+				return err
 			}
+			nrec++
 		}
+		att.ExcludeN(utils.AttrNotSampled, len(pool)-len(insets))
+	}
+	att.Records = nrec
 
-		// A record for this subject
-		r := utils.Drec{
-			Hf:        hf,
-			HfDate:    hfdate,
-			CvrgStart: d0,
-			CvrgEnd:   d1,
-			Elix:      bcomp(elx),
-			Thrgrp:    bcomp(thg),
-			Procgrp:   bcomp(pcx),
-			DOB:       adobyr[0],
-			Sex:       asex[0],
+	// The marker is only written once the shard and states are
+	// complete.
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return err
 		}
+	}
+	if err := markDone(k, &bucketMarker{att, diff}); err != nil {
+		return err
+	}
+	logger.Printf("Finished bucket %d, %d records\n", k, nrec)
 
-		rslt <- r
+	return nil
+}
+
+// reportFailed writes a summary of the failed buckets to the log and
+// to stderr.
+func reportFailed(failed []bucketResult) {
+	sort.Slice(failed, func(i, j int) bool { return failed[i].k < failed[j].k })
+	msg := fmt.Sprintf("%d buckets failed:\n", len(failed))
+	for _, r := range failed {
+		msg += fmt.Sprintf("  bucket %d: %v\n", r.k, r.err)
 	}
+	logger.Print(msg)
+	os.Stderr.WriteString(msg)
 }
 
-func setuplog() {
+// fatal reports an error that ends the run, and exits.
+func fatal(err error) {
+	if logger != nil {
+		logger.Print(err)
+	}
+	os.Stderr.WriteString(fmt.Sprintf("hfdat: %v\n", err))
+	os.Exit(1)
+}
+
+func setuplog() error {
 	fid, err := os.Create("hfdat.log")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	logger = log.New(fid, "", log.Ltime)
+	return nil
+}
+
+// makeHeader returns the header for the output file.  The creation
+// time is set by harvest, so the header can be compared between runs.
+func makeHeader() *utils.Header {
+
+	// The configuration directories, as absolute paths where possible
+	var confdirs []string
+	for _, t := range spec.Tables {
+		d, err := filepath.Abs(t.Dir)
+		if err != nil {
+			d = t.Dir
+		}
+		confdirs = append(confdirs, d)
+	}
+
+	codesets := []utils.CodeSetVersion{
+		{Name: "outcome", Version: hfdef.String()},
+		{Name: "charlson", Version: utils.Charlson.String()},
+	}
+	codesets = append(codesets, elixsum...)
+
+	return &utils.Header{
+		Version:  utils.HeaderVersion,
+		Elix:     elxcat,
+		Charlson: utils.Charlson.Names(),
+		Thrgrp:   utils.GroupNames(utils.NumThrgrp),
+		Procgrp:  utils.GroupNames(utils.NumProcgrp),
+		Outcome:  hfdef.String(),
+		CodeSets: codesets,
+		Configs:  confdirs,
+		Revision: revision,
+		Previous: prevdir,
+		PseudoID: idkey != nil,
+		Spec:     *spec,
+	}
+}
+
+// setupShards prepares the shard directory.  When resuming, the
+// header of the earlier run must match the header of this run.
+// Otherwise all completion markers and subject states are removed.
+func setupShards(resume bool) error {
+
+	if err := os.MkdirAll(sharddir, 0755); err != nil {
+		return err
+	}
+
+	hb, err := json.MarshalIndent(makeHeader(), "", "  ")
+	if err != nil {
+		return err
+	}
+	hname := path.Join(sharddir, "header.json")
+
+	if resume {
+		old, err := ioutil.ReadFile(hname)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(old, hb) {
+			return fmt.Errorf("can't resume, %s does not match the current cohort definition", hname)
+		}
+		return nil
+	}
+
+	fl, err := ioutil.ReadDir(sharddir)
+	if err != nil {
+		return err
+	}
+	for _, f := range fl {
+		if strings.HasSuffix(f.Name(), ".done") || strings.HasPrefix(f.Name(), "state_") {
+			if err := os.Remove(path.Join(sharddir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ioutil.WriteFile(hname, hb, 0644)
+}
+
+// setupRefresh checks that the run in the shard directory dir can be
+// refreshed by this run.  The cohort definition must be the same,
+// apart from the table configurations, which point to the new claims.
+// The states of all nbucket buckets must be present.
+func setupRefresh(dir string, nbucket int) error {
+
+	adir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	ashard, err := filepath.Abs(sharddir)
+	if err != nil {
+		return err
+	}
+	if adir == ashard {
+		return fmt.Errorf("can't refresh %s in place, use a new shard directory", dir)
+	}
+
+	b, err := ioutil.ReadFile(path.Join(dir, "header.json"))
+	if err != nil {
+		return err
+	}
+	prev := new(utils.Header)
+	if err := json.Unmarshal(b, prev); err != nil {
+		return fmt.Errorf("%s: %v", path.Join(dir, "header.json"), err)
+	}
+	if prev.Version != utils.HeaderVersion {
+		return fmt.Errorf("can't refresh %s, it was written with header version %d, this program writes version %d",
+			dir, prev.Version, utils.HeaderVersion)
+	}
+
+	// The fields that may differ between the runs
+	blank := func(hdr *utils.Header) ([]byte, error) {
+		h := *hdr
+		h.Created = ""
+		h.Configs = nil
+		h.Revision = 0
+		h.Previous = ""
+		h.Spec.Tables = append([]utils.TableSpec(nil), h.Spec.Tables...)
+		for j := range h.Spec.Tables {
+			h.Spec.Tables[j].Dir = ""
+		}
+		return json.Marshal(&h)
+	}
+	pb, err := blank(prev)
+	if err != nil {
+		return err
+	}
+	cb, err := blank(makeHeader())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pb, cb) {
+		return fmt.Errorf("can't refresh %s, its cohort definition does not match the current one", dir)
+	}
+
+	for k := 0; k < nbucket; k++ {
+		if _, err := os.Stat(path.Join(dir, fmt.Sprintf("bucket_%04d.done", k))); err != nil {
+			return fmt.Errorf("can't refresh %s, bucket %d is not complete", dir, k)
+		}
+		if _, err := os.Stat(stateName(dir, k)); err != nil {
+			return fmt.Errorf("can't refresh %s, it was not run with -save-state: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(stateName(dir, nbucket)); err == nil {
+		return fmt.Errorf("can't refresh %s, it has more than %d buckets", dir, nbucket)
+	}
+
+	revision = prev.Revision + 1
+	prevdir = adir
+	logger.Printf("Refreshing revision %d in %s\n", prev.Revision, adir)
+
+	return nil
+}
+
+// readShard returns the records in the shard for bucket k, sorted by
+// subject ID.  In the nested case-control design a subject may appear
+// in several matched sets, these records are ordered by MatchSet.
+func readShard(k int) ([]utils.Drec, error) {
+
+	fid, err := os.Open(shardName(k))
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", shardName(k), err)
+	}
+	defer gid.Close()
+	dec := gob.NewDecoder(gid)
+
+	var recs []utils.Drec
+	for {
+		var r utils.Drec
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", shardName(k), err)
+		}
+		recs = append(recs, r)
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].ID != recs[j].ID {
+			return recs[i].ID < recs[j].ID
+		}
+		return recs[i].MatchSet < recs[j].MatchSet
+	})
+
+	return recs, nil
 }
 
-// harvest collects data from all buckets
-func harvest() {
+// harvest merges the shards from all completed buckets into
+// hfdat.gob.gz, ordered by bucket and then by subject ID, so that
+// the output does not depend on the order in which the buckets were
+// processed.
+func harvest(nbucket int) error {
+
+	oif, err := os.Create("hfdat.gob.gz")
+	if err != nil {
+		return err
+	}
+	defer oif.Close()
+	oig := gzip.NewWriter(oif)
+	defer oig.Close()
 
 	enc := gob.NewEncoder(oig)
 
-	// First write the Elixhauser category names to the gob.
-	err := enc.Encode(elxcat)
+	// First write the header to the gob.
+	hdr := makeHeader()
+	hdr.Created, err = utils.CreationTime()
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(hdr)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// The remainder of the gob file is the sequence of records, 1 per subject.
-	for r := range rslt {
-		err := enc.Encode(r)
+	nrec := 0
+	for k := 0; k < nbucket; k++ {
+
+		// Only reached with -keep-going
+		if !bucketDone(k) {
+			logger.Printf("Bucket %d is not complete, not included in hfdat.gob.gz\n", k)
+			continue
+		}
+
+		recs, err := readShard(k)
+		if err != nil {
+			return err
+		}
+		for i := range recs {
+			if err := enc.Encode(&recs[i]); err != nil {
+				return err
+			}
+		}
+		nrec += len(recs)
+	}
+
+	if err := oig.Close(); err != nil {
+		return err
+	}
+	if err := oif.Close(); err != nil {
+		return err
+	}
+	logger.Printf("Wrote %d records to hfdat.gob.gz\n", nrec)
+
+	return writeAttrition(nbucket)
+}
+
+// writeAttrition sums the attrition counts of all buckets, and writes
+// them to attrition.json and, as a flow table, to attrition.txt.
+// When refreshing, the changes to the cohort are written to diff.json
+// and diff.txt.
+func writeAttrition(nbucket int) error {
+
+	rpt := &utils.AttritionReport{Total: utils.NewAttrition()}
+	diff := new(utils.RefreshDiff)
+	for k := 0; k < nbucket; k++ {
+		if !bucketDone(k) {
+			continue
+		}
+		mk, err := readMarker(k)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		rpt.Buckets = append(rpt.Buckets, mk.Attrition)
+		rpt.Total.Add(mk.Attrition)
+		if mk.Diff != nil {
+			diff.Add(mk.Diff)
+		}
+	}
+
+	b, err := json.MarshalIndent(rpt, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile("attrition.json", b, 0644); err != nil {
+		return err
+	}
+
+	tab := rpt.Total.Table()
+	if err := ioutil.WriteFile("attrition.txt", []byte(tab), 0644); err != nil {
+		return err
+	}
+	logger.Printf("Cohort attrition:\n%s", tab)
+
+	if prevdir == "" {
+		return nil
+	}
+
+	b, err = json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile("diff.json", b, 0644); err != nil {
+		return err
 	}
+
+	tab = diff.Table()
+	if err := ioutil.WriteFile("diff.txt", []byte(tab), 0644); err != nil {
+		return err
+	}
+	logger.Printf("Changes since %s:\n%s", prevdir, tab)
+	return nil
 }
 
 // setHF finds the HF ICD codes.
-func setHF() {
+func setHF() error {
+
+	var err error
+	hfdef, err = spec.Outcome.CodeSet()
+	if err != nil {
+		return err
+	}
+	logger.Printf("Heart failure definition: %s (%s)\n", hfdef, hfdef.Description)
+
+	phen, err = utils.LookupPhenotype(spec.Outcome.Phenotype)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Heart failure phenotype: %s (%s)\n", phen.Name, phen.Description)
+
+	if hfdef.ElixCat == "" {
+		var u []int
+		for x, c := range dxcodes {
+			if hfdef.Match(x) {
+				u = append(u, c)
+			}
+		}
+		hfcodes = cohort.SortUniq(u)
+		return nil
+	}
 
 	ii := -1
 	for j, c := range elxcat {
-		if c == "CHF" {
+		if c == hfdef.ElixCat {
 			ii = j
 			break
 		}
 	}
 	if ii == -1 {
-		panic("can't find CHF category\n")
+		return fmt.Errorf("can't find %s category", hfdef.ElixCat)
 	}
 	hfcodes = elix[ii]
+	return nil
+}
+
+// setupSpec reads the cohort specification and the table
+// configurations.  Directories given on the command line override
+// those in the specification.
+func setupSpec(specfile string, dirs []string) error {
+
+	var err error
+	if specfile != "" {
+		spec, err = utils.ReadSpec(specfile)
+		if err != nil {
+			return err
+		}
+	} else {
+		spec = utils.DefaultSpec()
+	}
+
+	if len(dirs) > 0 {
+		if len(dirs) != len(spec.Tables) {
+			return fmt.Errorf("%d configuration directories given, %d tables in the cohort specification",
+				len(dirs), len(spec.Tables))
+		}
+		for j := range dirs {
+			spec.Tables[j].Dir = dirs[j]
+		}
+	}
+
+	for _, t := range spec.Tables {
+		if t.Dir == "" {
+			return fmt.Errorf("no configuration directory for table %s", t.Name)
+		}
+		confs = append(confs, config.GetConfig(t.Dir))
+	}
+
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	logger.Printf("Cohort specification:\n%s\n", b)
+	return nil
 }
 
 func main() {
 
-	if len(os.Args) != 7 {
-		os.Stderr.WriteString("Usage:\nhfdat aconfig oconfig sconfig iconfig fconfig dconfig\n")
+	specfile := flag.String("spec", "", "JSON file containing the cohort specification")
+	keyfile := flag.String("idkey", "", "File containing a key used to pseudonymize enrollee ids")
+	resume := flag.Bool("resume", false, "Skip buckets that were completed by an earlier run")
+	keepGoing := flag.Bool("keep-going", false, "Continue past buckets that fail, leaving them out of hfdat.gob.gz")
+	flag.StringVar(&sharddir, "shards", "shards", "Directory for the per-bucket shard files")
+	refresh := flag.String("refresh", "", "Shard directory of an earlier run to refresh with the claims in the tables of the cohort spec")
+	flag.BoolVar(&savestate, "save-state", false, "Keep the subject states in the shard directory, so that the cohort can be refreshed")
+	flag.Usage = func() {
+		os.Stderr.WriteString("Usage:\nhfdat [-spec cohort.json] [-idkey keyfile] [-resume] [-keep-going] [-shards dir] [-save-state] [-refresh prevdir] [aconfig oconfig sconfig iconfig fconfig dconfig]\n")
+	}
+	flag.Parse()
+
+	if *specfile == "" && flag.NArg() != 6 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	setuplog()
+	if err := setuplog(); err != nil {
+		fatal(err)
+	}
+
+	if err := setupSpec(*specfile, flag.Args()); err != nil {
+		fatal(err)
+	}
+
+	if *keyfile != "" {
+		var err error
+		idkey, err = utils.ReadKey(*keyfile)
+		if err != nil {
+			fatal(err)
+		}
+		logger.Printf("Enrollee ids are pseudonymized\n")
+	}
+
+	ix := spec.TableIndex("O")
+	if ix == -1 {
+		fatal(fmt.Errorf("the cohort specification has no O table"))
+	}
+	oconf := confs[ix]
+
+	dxcodes = config.GetFactorCodes("Dx", oconf)
+
+	sem = make(chan bool, concurrency)
 
 	var err error
-	oif, err = os.Create("hfdat.gob.gz")
+	elix, elxcat, err = getElix()
 	if err != nil {
-		panic(err)
+		fatal(err)
 	}
-	defer oif.Close()
+	for sev, mild := range utils.ElixHier {
+		if sortedIndex(elxcat, sev) == -1 || sortedIndex(elxcat, mild) == -1 {
+			logger.Printf("Elixhauser hierarchy %s over %s not applied, category not found\n", sev, mild)
+		}
+	}
+	charl = utils.Charlson.Codes(dxcodes, false)
+	charl10 = utils.Charlson.Codes(dxcodes, true)
 
-	oig = gzip.NewWriter(oif)
-	defer oig.Close()
+	if err := setHF(); err != nil {
+		fatal(err)
+	}
 
-	adir = os.Args[1]
-	odir = os.Args[2]
-	sdir = os.Args[3]
-	idir = os.Args[4]
-	fdir = os.Args[5]
-	ddir = os.Args[6]
+	builder = &cohort.Builder{
+		Spec:       spec,
+		HFCodes:    hfcodes,
+		Phenotype:  phen,
+		ElixNames:  elxcat,
+		Elix:       elix,
+		Charlson:   charl,
+		Charlson10: charl10,
+		IDKey:      idkey,
+	}
 
-	aconf = config.GetConfig(adir)
-	oconf = config.GetConfig(odir)
-	sconf = config.GetConfig(sdir)
-	iconf = config.GetConfig(idir)
-	fconf = config.GetConfig(fdir)
-	dconf = config.GetConfig(ddir)
+	nbucket := int(oconf.NumBuckets)
+	if *refresh != "" {
+		if err := setupRefresh(*refresh, nbucket); err != nil {
+			fatal(err)
+		}
+	}
 
-	dxcodes = config.GetFactorCodes("Dx", oconf)
+	if err := setupShards(*resume); err != nil {
+		fatal(err)
+	}
 
-	dix = []string{"A", "O", "S", "I", "F", "D"}
+	// Results from the bucket workers, and the buckets that failed
+	results := make(chan bucketResult, nbucket)
+	var failed []bucketResult
+	collect := func(r bucketResult) {
+		if r.err != nil {
+			logger.Printf("Bucket %d failed: %v\n", r.k, r.err)
+			failed = append(failed, r)
+		}
+	}
 
-	sem = make(chan bool, concurrency)
-	rslt = make(chan utils.Drec, 200)
+	nrun, ndone := 0, 0
+	for k := 0; k < nbucket; k++ {
+		if *resume && bucketDone(k) {
+			logger.Printf("Skipping completed bucket %d\n", k)
+			continue
+		}
 
-	elix, elxcat = getElix()
+		// Collect the buckets that have finished, and stop starting
+		// new buckets after a failure unless -keep-going is set.
+		for more := true; more; {
+			select {
+			case r := <-results:
+				collect(r)
+				ndone++
+			default:
+				more = false
+			}
+		}
+		if len(failed) > 0 && !*keepGoing {
+			break
+		}
 
-	setHF()
+		sem <- true
+		nrun++
+		go func(k int) {
+			defer func() { <-sem }()
+			results <- bucketResult{k, dobucket(k)}
+		}(k)
+	}
 
-	go harvest()
+	for ; ndone < nrun; ndone++ {
+		collect(<-results)
+	}
 
-	for k := 0; k < int(oconf.NumBuckets); k++ {
-		sem <- true
-		go dobucket(k)
+	if len(failed) > 0 && !*keepGoing {
+		reportFailed(failed)
+		os.Exit(1)
 	}
 
-	for k := 0; k < concurrency; k++ {
-		sem <- true
+	if err := harvest(nbucket); err != nil {
+		fatal(err)
 	}
 
-	close(rslt)
+	if len(failed) > 0 {
+		reportFailed(failed)
+		os.Exit(1)
+	}
 }
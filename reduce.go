@@ -4,6 +4,9 @@ Reduce a large spares matrix to factors, using an approximate SVD.
 Right now this is hard-coded to work on the Procgrp data from hfdat.gob.gz, but
 could be generalized to work on other data.
 
+With -bysource, each procedure group is split into separate columns for each
+of the claims tables in which it was seen.
+
 The resulting factors are stored in the 'data' directory as binary columns.
 */
 
@@ -12,8 +15,8 @@ package main
 import (
 	"compress/gzip"
 	"encoding/binary"
-	"encoding/gob"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,41 +31,50 @@ import (
 	"github.com/brookluers/hfp/utils"
 )
 
-func doFactorize(nfac, npow int) (int, *mat.Dense, *mat.Dense) {
+// doFactorize returns the number of subjects, the left and right
+// singular vectors, and the number of output rows for each subject
+// (the number of counting-process intervals, or 1 if there are no
+// intervals).
+func doFactorize(nfac, npow int, bysource bool) (int, *mat.Dense, *mat.Dense, []int, error) {
 
-	// Setup gob file reader
-	inf, err := os.Open("hfdat.gob.gz")
-	if err != nil {
-		panic(err)
-	}
-	defer inf.Close()
-	gnf, err := gzip.NewReader(inf)
+	// Setup gob file reader, the first element is the header
+	cr, err := utils.OpenCohort("hfdat.gob.gz")
 	if err != nil {
-		panic(err)
+		return 0, nil, nil, nil, err
 	}
-	dec := gob.NewDecoder(gnf)
-
-	// The first element is the Elixhauser category names
-	var elxcat []string
-	err = dec.Decode(&elxcat)
-	if err != nil {
-		panic(err)
+	defer cr.Close()
+	hdr := cr.Header
+
+	// Number of columns, the procedure groups for each source table
+	ntab := 1
+	if bysource {
+		// Files written before the header was versioned may not
+		// record the source tables (Drec.ProcSrc)
+		if hdr.Version < 1 {
+			return 0, nil, nil, nil, fmt.Errorf("-bysource needs header version 1 or later, hfdat.gob.gz has version %d", hdr.Version)
+		}
+		ntab = len(hdr.Spec.Tables)
 	}
+	nproc := len(hdr.Procgrp)
+	ncol := nproc * ntab
 
 	// The sparse matrix is represented as mat[row[i], col[i]] = dat[i]
 	var row, col []int
 	var dat []float64
 
+	// Number of rows written by data.go for each subject
+	var reps []int
+
 	var nrec int
 	for {
 
 		// Read one subject record
 		var r utils.Drec
-		err := dec.Decode(&r)
+		err := cr.Next(&r)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			panic(err)
+			return 0, nil, nil, nil, fmt.Errorf("reading hfdat.gob.gz: %v", err)
 		}
 
 		// We will eventually select ages 50-65 so this is
@@ -73,17 +85,33 @@ func doFactorize(nfac, npow int) (int, *mat.Dense, *mat.Dense) {
 		}
 		nrec++
 
+		if hdr.Spec.Intervals != "" {
+			reps = append(reps, len(r.Intervals))
+		} else {
+			reps = append(reps, 1)
+		}
+
 		// Add an entry to the sparse matrix
-		for _, g := range r.Procgrp {
-			row = append(row, nrec)
-			col = append(col, g)
-			dat = append(dat, 1)
+		for i, g := range r.Procgrp {
+			if !bysource {
+				row = append(row, nrec)
+				col = append(col, g)
+				dat = append(dat, 1)
+				continue
+			}
+			for j := 0; j < ntab; j++ {
+				if i < len(r.ProcSrc) && r.ProcSrc[i]&(1<<uint(j)) != 0 {
+					row = append(row, nrec)
+					col = append(col, j*nproc+g)
+					dat = append(dat, 1)
+				}
+			}
 		}
 	}
 	fmt.Printf("Processsed %d records\n", nrec)
 
 	// Run the approximate SVD
-	spm := dimred.NewSPM(row, col, dat, nrec, 500)
+	spm := dimred.NewSPM(row, col, dat, nrec, ncol)
 	sv := new(dimred.RSVD)
 	sv.Factorize(spm, nfac, npow)
 	umat := sv.UTo(nil)
@@ -118,13 +146,15 @@ func doFactorize(nfac, npow int) (int, *mat.Dense, *mat.Dense) {
 		}
 	}
 
-	return nrec, umat, vmat
+	return nrec, umat, vmat, reps, nil
 }
 
-//  store writes column in binary form
-func store(ma *mat.Dense, dir, pre string, sf float64) {
+//  store writes column in binary form, row i of ma is written reps[i]
+// times.
+func store(ma *mat.Dense, reps []int, dir, pre string, sf float64) error {
 
 	var out []io.WriteCloser
+	var files []*os.File
 	nrow, ncol := ma.Dims()
 
 	// Create the destination file writers
@@ -132,47 +162,67 @@ func store(ma *mat.Dense, dir, pre string, sf float64) {
 		fname := path.Join(dir, fmt.Sprintf("%s_%03d.bin.gz", pre, j))
 		f, err := os.Create(fname)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		defer f.Close()
 		z := gzip.NewWriter(f)
 		defer z.Close()
 		out = append(out, z)
+		files = append(files, f)
 	}
 
 	// Write the data
 	for i := 0; i < nrow; i++ {
-		for j := 0; j < ncol; j++ {
-			err := binary.Write(out[j], binary.LittleEndian, sf*ma.At(i, j))
-			if err != nil {
-				panic(err)
+		for k := 0; k < reps[i]; k++ {
+			for j := 0; j < ncol; j++ {
+				err := binary.Write(out[j], binary.LittleEndian, sf*ma.At(i, j))
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
+
+	// Check for errors flushing the data
+	for j := range out {
+		if err := out[j].Close(); err != nil {
+			return err
+		}
+		if err := files[j].Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // storev stores the v matrix of the approximate SVD in a file.
-func storev(m *mat.Dense, fname string) {
+func storev(m *mat.Dense, fname string) error {
 
 	f, err := os.Create(fname)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer f.Close()
 	g := gzip.NewWriter(f)
-	defer g.Close()
 
-	m.MarshalBinaryTo(g)
+	if _, err := m.MarshalBinaryTo(g); err != nil {
+		return err
+	}
+	if err := g.Close(); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 // dtypes updates the dtype information in the data directory.
-func dtypes() {
+func dtypes() error {
 
 	dt := make(map[string]string)
 
 	fi, err := ioutil.ReadDir("data")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	for _, f := range fi {
@@ -185,28 +235,46 @@ func dtypes() {
 
 	out, err := os.Create("data/dtypes.json")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	enc := json.NewEncoder(out)
-	err = enc.Encode(&dt)
-	if err != nil {
-		panic(err)
+	if err := enc.Encode(&dt); err != nil {
+		out.Close()
+		return err
 	}
+	return out.Close()
 }
 
 func main() {
 
+	bysource := flag.Bool("bysource", false, "Use separate columns for each table in which a procedure group is seen")
+	flag.Parse()
+
 	// Number of factors to extract
 	nfac := 20
 
 	// Number of power iterations to apply during the approximate SVD
 	npow := 5
 
-	n, umat, vmat := doFactorize(nfac, npow)
+	fail := func(err error) {
+		os.Stderr.WriteString(fmt.Sprintf("reduce: %v\n", err))
+		os.Exit(1)
+	}
 
-	store(umat, "data", "PG", math.Sqrt(float64(n)))
+	n, umat, vmat, reps, err := doFactorize(nfac, npow, *bysource)
+	if err != nil {
+		fail(err)
+	}
+
+	if err := store(umat, reps, "data", "PG", math.Sqrt(float64(n))); err != nil {
+		fail(err)
+	}
 
-	storev(vmat, "procgrp_v.bin.gz")
+	if err := storev(vmat, "procgrp_v.bin.gz"); err != nil {
+		fail(err)
+	}
 
-	dtypes()
+	if err := dtypes(); err != nil {
+		fail(err)
+	}
 }
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Exclusion steps applied by hfdat, in order
+const (
+	AttrNoEligible    = "No year with enough coverage"
+	AttrOneYear       = "Only one year of coverage"
+	AttrShortCoverage = "Coverage ends in the baseline window"
+	AttrPrevalent     = "Heart failure in the baseline window"
+	AttrNotSampled    = "Control not sampled"
+	AttrStale         = "Baseline window moved, needs a full run"
+)
+
+// AttritionStep is one exclusion step in the construction of the
+// cohort.
+type AttritionStep struct {
+
+	// Description of the step
+	Name string
+
+	// Number of subjects excluded at this step
+	Excluded int
+}
+
+// Attrition counts the subjects excluded at each step of the
+// construction of the cohort.
+type Attrition struct {
+
+	// Number of subjects before any exclusions
+	Subjects int
+
+	// The exclusion steps, in the order they are applied
+	Steps []AttritionStep
+
+	// Number of cases among the retained subjects
+	Cases int
+
+	// Number of records written, which differs from the number of
+	// retained subjects in the nested case-control design
+	Records int
+}
+
+// NewAttrition returns an Attrition with the given steps and no
+// exclusions.
+func NewAttrition(steps ...string) *Attrition {
+	a := new(Attrition)
+	for _, s := range steps {
+		a.Steps = append(a.Steps, AttritionStep{Name: s})
+	}
+	return a
+}
+
+// Exclude counts one subject as excluded at the named step, which is
+// added after the existing steps if it is not present.
+func (a *Attrition) Exclude(step string) {
+	a.ExcludeN(step, 1)
+}
+
+// ExcludeN counts n subjects as excluded at the named step.
+func (a *Attrition) ExcludeN(step string, n int) {
+	for i := range a.Steps {
+		if a.Steps[i].Name == step {
+			a.Steps[i].Excluded += n
+			return
+		}
+	}
+	a.Steps = append(a.Steps, AttritionStep{step, n})
+}
+
+// Add adds the counts in b to a.
+func (a *Attrition) Add(b *Attrition) {
+	a.Subjects += b.Subjects
+	a.Cases += b.Cases
+	a.Records += b.Records
+	for _, s := range b.Steps {
+		a.ExcludeN(s.Name, s.Excluded)
+	}
+}
+
+// Retained returns the number of subjects remaining after all
+// exclusions.
+func (a *Attrition) Retained() int {
+	n := a.Subjects
+	for _, s := range a.Steps {
+		n -= s.Excluded
+	}
+	return n
+}
+
+// Table returns a printable flow table.
+func (a *Attrition) Table() string {
+
+	var buf bytes.Buffer
+	n := a.Subjects
+	fmt.Fprintf(&buf, "%-45s %12d\n", "Subjects", n)
+	for _, s := range a.Steps {
+		n -= s.Excluded
+		fmt.Fprintf(&buf, "  - %-41s %12d %12d\n", s.Name, s.Excluded, n)
+	}
+	fmt.Fprintf(&buf, "%-45s %12d\n", "Retained subjects", n)
+	fmt.Fprintf(&buf, "%-45s %12d\n", "Cases", a.Cases)
+	fmt.Fprintf(&buf, "%-45s %12d\n", "Records", a.Records)
+
+	return buf.String()
+}
+
+// AttritionReport is written to attrition.json by hfdat.
+type AttritionReport struct {
+
+	// Counts for the whole cohort
+	Total *Attrition
+
+	// Counts for each bucket
+	Buckets []*Attrition
+}
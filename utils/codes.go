@@ -1,10 +1,136 @@
 package utils
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CodeSet is a named, versioned set of ICD-9 and ICD-10 diagnosis
+// codes.  Codes are written without the decimal point.  Each entry
+// is either an exact code (e.g. "I110"), a prefix ending in "*"
+// (e.g. "I50*"), or an inclusive range of prefixes with equal length
+// (e.g. "4280-4289").
+type CodeSet struct {
+
+	// Name of the code set
+	Name string
+
+	// Version of the code set, incremented whenever the codes change
+	Version int
+
+	// A short description of the code set
+	Description string
+
+	// ICD-9 codes
+	ICD9 []string
+
+	// ICD-10 codes
+	ICD10 []string
+
+	// If not empty, the codes are taken from this Elixhauser
+	// category rather than from ICD9 and ICD10
+	ElixCat string
+}
+
 var (
-	// Need ICD-10 codes too
-	HfCodes = []string{"39891", "40201", "40211", "40291", "40401",
-		"40403", "40411", "40413", "40491", "40493", "42800",
-		"42810", "42820", "42821", "42822", "42823", "42830",
-		"42831", "42832", "42833", "42840", "42841", "42842",
-		"42843", "42890"}
+	// NarrowHF is a narrow heart failure definition.
+	NarrowHF = &CodeSet{
+		Name:        "narrow_hf",
+		Version:     1,
+		Description: "Heart failure, including hypertensive and rheumatic heart disease with heart failure",
+		ICD9: []string{"39891", "40201", "40211", "40291", "40401",
+			"40403", "40411", "40413", "40491", "40493", "428*"},
+		ICD10: []string{"I0981", "I110", "I130", "I132", "I50*"},
+	}
+
+	// ElixCHF defines heart failure using the Elixhauser congestive
+	// heart failure category.
+	ElixCHF = &CodeSet{
+		Name:        "elix_chf",
+		Version:     1,
+		Description: "Elixhauser congestive heart failure category",
+		ElixCat:     "CHF",
+	}
+
+	// OutcomeDefs contains all available outcome definitions.
+	OutcomeDefs = []*CodeSet{NarrowHF, ElixCHF}
 )
+
+// String returns the name and version of the code set.
+func (cs *CodeSet) String() string {
+	return fmt.Sprintf("%s@%d", cs.Name, cs.Version)
+}
+
+// LookupOutcome returns the outcome definition with the given name.
+// A specific version can be requested by appending "@version" to the
+// name, otherwise the most recent version is returned.
+func LookupOutcome(name string) (*CodeSet, error) {
+
+	full := name
+	ver := -1
+	if i := strings.Index(name, "@"); i != -1 {
+		v, err := strconv.Atoi(name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid outcome definition version in '%s'", full)
+		}
+		name, ver = name[0:i], v
+	}
+
+	var cs *CodeSet
+	for _, d := range OutcomeDefs {
+		if d.Name != name {
+			continue
+		}
+		if d.Version == ver {
+			return d, nil
+		}
+		if ver == -1 && (cs == nil || d.Version > cs.Version) {
+			cs = d
+		}
+	}
+
+	if cs == nil {
+		return nil, fmt.Errorf("unknown outcome definition '%s'", full)
+	}
+
+	return cs, nil
+}
+
+// Match returns true if the given code belongs to the code set.
+func (cs *CodeSet) Match(code string) bool {
+	for _, p := range cs.ICD9 {
+		if matchCode(p, code) {
+			return true
+		}
+	}
+	for _, p := range cs.ICD10 {
+		if matchCode(p, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// ICD10Start is the first day (days since 1960-01-01) on which claims
+// are coded with ICD-10, October 1, 2015.
+const ICD10Start = 20362
+
+// matchCode returns true if the code matches the pattern.
+func matchCode(pat, code string) bool {
+
+	if strings.HasSuffix(pat, "*") {
+		return strings.HasPrefix(code, pat[0:len(pat)-1])
+	}
+
+	if i := strings.Index(pat, "-"); i != -1 {
+		lo, hi := pat[0:i], pat[i+1:]
+		if len(code) < len(lo) {
+			return false
+		}
+		c := code[0:len(lo)]
+		return c >= lo && c <= hi
+	}
+
+	return code == pat
+}
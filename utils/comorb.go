@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ComorbidityCat is one category of a comorbidity index.  See
+// CodeSet for the format of the codes.
+type ComorbidityCat struct {
+
+	// Short name of the category
+	Name string
+
+	// Weight of the category in the index score
+	Weight int
+
+	// ICD-9 and ICD-10 codes
+	ICD9  []string
+	ICD10 []string
+
+	// A less severe category that is not counted in the score when
+	// this category is present
+	Supersedes string
+}
+
+// Match returns true if the code belongs to the category.  The code
+// is an ICD-10 code if icd10 is true, otherwise an ICD-9 code.  The
+// two code sets overlap (e.g. ICD-9 V434 and ICD-10 V434xx), so the
+// patterns are only tested against codes of their own version.
+func (c *ComorbidityCat) Match(code string, icd10 bool) bool {
+	pats := c.ICD9
+	if icd10 {
+		pats = c.ICD10
+	}
+	for _, p := range pats {
+		if matchCode(p, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// ComorbidityMap is a named, versioned comorbidity index.
+type ComorbidityMap struct {
+
+	// Name of the index
+	Name string
+
+	// Version of the index, incremented whenever the codes or weights
+	// change
+	Version int
+
+	// The categories, in the order they are stored in Drec
+	Cats []ComorbidityCat
+}
+
+// String returns the name and version of the index.
+func (cm *ComorbidityMap) String() string {
+	return fmt.Sprintf("%s@%d", cm.Name, cm.Version)
+}
+
+// Names returns the names of the categories.
+func (cm *ComorbidityMap) Names() []string {
+	var u []string
+	for _, c := range cm.Cats {
+		u = append(u, c.Name)
+	}
+	return u
+}
+
+// Score returns the weighted score for a subject having the given
+// categories (indices into Cats, as stored in Drec).  A category is
+// not counted when a category that supersedes it is present.
+func (cm *ComorbidityMap) Score(cats []int) int {
+
+	have := make(map[string]bool)
+	for _, j := range cats {
+		have[cm.Cats[j].Name] = true
+	}
+	for _, j := range cats {
+		if s := cm.Cats[j].Supersedes; s != "" {
+			delete(have, s)
+		}
+	}
+
+	var score int
+	for _, c := range cm.Cats {
+		if have[c.Name] {
+			score += c.Weight
+		}
+	}
+
+	return score
+}
+
+// Codes returns, for each category, the sorted integer codes of the
+// ICD-9 (or if icd10 is true, ICD-10) diagnosis codes in the
+// category.  dxcodes maps the diagnosis codes to their integer
+// representation.
+func (cm *ComorbidityMap) Codes(dxcodes map[string]int, icd10 bool) [][]int {
+
+	cx := make([][]int, len(cm.Cats))
+	for x, c := range dxcodes {
+		for j := range cm.Cats {
+			if cm.Cats[j].Match(x, icd10) {
+				cx[j] = append(cx[j], c)
+			}
+		}
+	}
+
+	for j := range cx {
+		sort.Ints(cx[j])
+	}
+
+	return cx
+}
+
+// Charlson is the Charlson comorbidity index, using the ICD-9-CM and
+// ICD-10 coding algorithms of Quan et al. (Med Care 2005) and the
+// original Charlson weights.
+var Charlson = &ComorbidityMap{
+	Name:    "charlson_quan",
+	Version: 2,
+	Cats: []ComorbidityCat{
+		{
+			Name:   "MI",
+			Weight: 1,
+			ICD9:   []string{"410*", "412*"},
+			ICD10:  []string{"I21*", "I22*", "I252*"},
+		},
+		{
+			Name:   "CHF",
+			Weight: 1,
+			ICD9: []string{"39891*", "40201*", "40211*", "40291*", "40401*", "40403*",
+				"40411*", "40413*", "40491*", "40493*", "4254-4259", "428*"},
+			ICD10: []string{"I099*", "I110*", "I130*", "I132*", "I255*", "I420*",
+				"I425-I429", "I43*", "I50*", "P290*"},
+		},
+		{
+			Name:   "PVD",
+			Weight: 1,
+			ICD9:   []string{"0930*", "4373*", "440*", "441*", "4431-4439", "4471*", "5571*", "5579*", "V434*"},
+			ICD10: []string{"I70*", "I71*", "I731*", "I738*", "I739*", "I771*", "I790*",
+				"I792*", "K551*", "K558*", "K559*", "Z958*", "Z959*"},
+		},
+		{
+			Name:   "CEVD",
+			Weight: 1,
+			ICD9:   []string{"36234*", "430-438"},
+			ICD10:  []string{"G45*", "G46*", "H340*", "I60-I69"},
+		},
+		{
+			Name:   "DEMENTIA",
+			Weight: 1,
+			ICD9:   []string{"290*", "2941*", "3312*"},
+			ICD10:  []string{"F00-F03", "F051*", "G30*", "G311*"},
+		},
+		{
+			Name:   "CPD",
+			Weight: 1,
+			ICD9:   []string{"4168*", "4169*", "490-505", "5064*", "5081*", "5088*"},
+			ICD10:  []string{"I278*", "I279*", "J40-J47", "J60-J67", "J684*", "J701*", "J703*"},
+		},
+		{
+			Name:   "RHEUM",
+			Weight: 1,
+			ICD9:   []string{"4465*", "7100-7104", "7140-7142", "7148*", "725*"},
+			ICD10:  []string{"M05*", "M06*", "M315*", "M32-M34", "M351*", "M353*", "M360*"},
+		},
+		{
+			Name:   "PUD",
+			Weight: 1,
+			ICD9:   []string{"531-534"},
+			ICD10:  []string{"K25-K28"},
+		},
+		{
+			Name:   "MILDLD",
+			Weight: 1,
+			ICD9: []string{"07022*", "07023*", "07032*", "07033*", "07044*", "07054*",
+				"0706*", "0709*", "570*", "571*", "5733*", "5734*", "5738*", "5739*", "V427*"},
+			ICD10: []string{"B18*", "K700-K703", "K709*", "K713-K715", "K717*", "K73*",
+				"K74*", "K760*", "K762-K764", "K768*", "K769*", "Z944*"},
+		},
+		{
+			Name:   "DIAB",
+			Weight: 1,
+			ICD9:   []string{"2500-2503", "2508*", "2509*"},
+			ICD10: []string{"E100*", "E101*", "E106*", "E108*", "E109*", "E110*", "E111*",
+				"E116*", "E118*", "E119*", "E120*", "E121*", "E126*", "E128*", "E129*",
+				"E130*", "E131*", "E136*", "E138*", "E139*", "E140*", "E141*", "E146*",
+				"E148*", "E149*"},
+		},
+		{
+			Name:       "DIABCX",
+			Weight:     2,
+			ICD9:       []string{"2504-2507"},
+			ICD10:      []string{"E102-E105", "E107*", "E112-E115", "E117*", "E122-E125", "E127*", "E132-E135", "E137*", "E142-E145", "E147*"},
+			Supersedes: "DIAB",
+		},
+		{
+			Name:   "PARA",
+			Weight: 2,
+			ICD9:   []string{"3341*", "342*", "343*", "3440-3446", "3449*"},
+			ICD10:  []string{"G041*", "G114*", "G801*", "G802*", "G81*", "G82*", "G830-G834", "G839*"},
+		},
+		{
+			Name:   "RENAL",
+			Weight: 2,
+			ICD9: []string{"40301*", "40311*", "40391*", "40402*", "40403*", "40412*",
+				"40413*", "40492*", "40493*", "582*", "5830-5837", "585*", "586*", "5880*",
+				"V420*", "V451*", "V56*"},
+			ICD10: []string{"I120*", "I131*", "N032-N037", "N052-N057", "N18*", "N19*",
+				"N250*", "Z490-Z492", "Z940*", "Z992*"},
+		},
+		{
+			Name:   "CANCER",
+			Weight: 2,
+			ICD9:   []string{"140-172", "174-194", "1950-1958", "200-208", "2386*"},
+			ICD10: []string{"C00-C26", "C30-C34", "C37-C41", "C43*", "C45-C58", "C60-C76",
+				"C81-C85", "C88*", "C90-C97"},
+		},
+		{
+			Name:       "MSLD",
+			Weight:     3,
+			ICD9:       []string{"4560-4562", "5722-5728"},
+			ICD10:      []string{"I850*", "I859*", "I864*", "I982*", "K704*", "K711*", "K721*", "K729*", "K765*", "K766*", "K767*"},
+			Supersedes: "MILDLD",
+		},
+		{
+			Name:       "METS",
+			Weight:     6,
+			ICD9:       []string{"196-199"},
+			ICD10:      []string{"C77-C80"},
+			Supersedes: "CANCER",
+		},
+		{
+			Name:   "HIV",
+			Weight: 6,
+			ICD9:   []string{"042-044"},
+			ICD10:  []string{"B20-B22", "B24*"},
+		},
+	},
+}
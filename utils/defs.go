@@ -1,14 +1,102 @@
 package utils
 
+import "sort"
+
+// Event types
+const (
+	// Follow-up ended without an event
+	EventCensored uint8 = iota
+
+	// Heart failure
+	EventHF
+
+	// Death before heart failure
+	EventDeath
+)
+
+// EDPlace is the place of service (Stdplac) code for an emergency
+// department.
+const EDPlace uint8 = 23
+
+// DeathStatus contains the discharge status (Dstatus) codes that
+// indicate the patient died.
+var DeathStatus = []uint8{20, 40, 41, 42}
+
+// IsDeathStatus returns true if the discharge status indicates that
+// the patient died.
+func IsDeathStatus(st uint8) bool {
+	for _, x := range DeathStatus {
+		if st == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Flags recording where a diagnosis was seen, see Drec.ElixSrc and
+// Drec.HfSrc.
+const (
+	// In the primary position (Dx1)
+	DxPrimary uint8 = 1 << iota
+
+	// On an inpatient claim (I or S table)
+	DxInpatient
+
+	// On an outpatient claim (O table)
+	DxOutpatient
+
+	// On a facility claim (F table)
+	DxFacility
+
+	// In the primary position of an inpatient claim
+	DxPrimaryInpatient
+)
+
+// DxSource returns the flags for a diagnosis seen in the named table,
+// in the primary position or not.
+func DxSource(table string, primary bool) uint8 {
+	var f uint8
+	switch {
+	case InpatientTable(table):
+		f = DxInpatient
+		if primary {
+			f |= DxPrimaryInpatient
+		}
+	case table == "O":
+		f = DxOutpatient
+	case table == "F":
+		f = DxFacility
+	}
+	if primary {
+		f |= DxPrimary
+	}
+	return f
+}
+
 // Drec describes one subject in the data set.
 type Drec struct {
 
+	// Enrollee id, or a keyed pseudonym of the id (see Pseudonym)
+	ID uint64
+
 	// Indicator that the subject has heart failure
 	Hf bool
 
 	// Date at which the subject first had heart failure
 	HfDate uint16
 
+	// Where the heart failure diagnoses on or before HfDate were
+	// seen, a combination of the Dx flags (DxPrimary, ...), 0 if Hf
+	// is false
+	HfSrc uint8
+
+	// The event ending follow-up, EventCensored, EventHF or
+	// EventDeath
+	Event uint8
+
+	// Date of the event, or of censoring
+	EventDate uint16
+
 	// First date of coverage
 	CvrgStart uint16
 
@@ -21,12 +109,116 @@ type Drec struct {
 	// Sex
 	Sex uint8
 
+	// Geographic region code
+	Region uint8
+
+	// Relationship to the employee code
+	Emprel uint8
+
+	// Probability that the subject was included in the sample, 1
+	// for cases
+	SampProb float64
+
+	// Indicator that the subject is in the subcohort of a case-cohort
+	// sample
+	SubCohort bool
+
+	// Nested case-control samples: the matched set containing this
+	// record (the ID of the set's case), 0 if not in a matched set
+	MatchSet uint64
+
+	// Nested case-control samples: indicator that this record is the
+	// case of its matched set
+	SetCase bool
+
+	// Nested case-control samples: the date on which the set's case
+	// developed heart failure
+	SetDate uint16
+
 	// Array of Elixhauser indicators
 	Elix []int
 
+	// Where each category in Elix was seen in the baseline window, a
+	// combination of the Dx flags
+	ElixSrc []uint8
+
+	// Charlson categories (indices into utils.Charlson.Cats) seen in
+	// the baseline window, and the Charlson score
+	Charlson   []int
+	CharlScore uint8
+
 	// Array of drug therapeutic group indicators
 	Thrgrp []int
 
+	// Number of fills of drugs in each therapeutic group during the
+	// baseline window, indexed by group (as in Thrgrp).  Nil if there
+	// are no fills.
+	RxFills []uint16
+
+	// Total days supply of drugs in each therapeutic group during the
+	// baseline window, indexed by group.  Nil if there are no fills
+	// or the days supply is not available.
+	RxDays []uint16
+
+	// Proportion of days in the baseline window covered by drugs in
+	// each therapeutic group, indexed by group.  Nil if there are no
+	// fills or the days supply is not available.
+	RxPDC []float64
+
 	// Array of procedure group codes
 	Procgrp []int
+
+	// The tables in which each procedure group in Procgrp was seen,
+	// bit j is set if the group was seen in the j^th table of the
+	// cohort specification
+	ProcSrc []uint8
+
+	// Number of days with an outpatient (O table) visit, other than
+	// in an emergency department, during the baseline window
+	OutVisits uint16
+
+	// Number of days with an emergency department visit (O, S or F
+	// table) during the baseline window
+	EDVisits uint16
+
+	// Number of inpatient admissions (I table) starting in the
+	// baseline window
+	InpAdmits uint16
+
+	// Total length of stay of the admissions in InpAdmits
+	InpDays uint16
+
+	// Counting-process intervals covering the follow-up period, with
+	// covariates updated over time.  Empty unless the cohort
+	// specification requests intervals.
+	Intervals []Interval
+}
+
+// ElixFlags returns the Dx flags of Elixhauser category j (an index
+// into the category names), 0 if the subject does not have the
+// category.
+func (r *Drec) ElixFlags(j int) uint8 {
+	i := sort.SearchInts(r.Elix, j)
+	if i == len(r.Elix) || r.Elix[i] != j || i >= len(r.ElixSrc) {
+		return 0
+	}
+	return r.ElixSrc[i]
+}
+
+// Interval is one (Start, Stop] interval of follow-up for a subject.
+type Interval struct {
+
+	// Start and end of the interval, in days since the end of the
+	// baseline window
+	Start, Stop uint16
+
+	// Indicator that heart failure occurred at the end of the
+	// interval
+	Event bool
+
+	// Elixhauser categories seen before the start of the interval
+	Elix []int
+
+	// Drug therapeutic groups seen before the start of the interval
+	Thrgrp []int
 }
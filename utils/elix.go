@@ -0,0 +1,115 @@
+package utils
+
+// ElixHier maps each Elixhauser category to the less severe category
+// that is dropped when both are present.
+var ElixHier = map[string]string{
+	"DMCX":  "DM",
+	"METS":  "TUMOR",
+	"HTNCX": "HTN",
+}
+
+// ElixHierarchy applies the ElixHier exclusions to a sorted list of
+// Elixhauser categories (indices into names, as stored in Drec).
+// Categories not in names are ignored.
+func ElixHierarchy(names []string, cats []int) []int {
+
+	have := make(map[string]bool)
+	for _, j := range cats {
+		have[names[j]] = true
+	}
+
+	var u []int
+	for _, j := range cats {
+		drop := false
+		for sev, mild := range ElixHier {
+			if names[j] == mild && have[sev] {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			u = append(u, j)
+		}
+	}
+
+	return u
+}
+
+// ElixScore is a weighted summary score of the Elixhauser categories.
+// The categories are identified by their AHRQ abbreviations.
+// Categories with no weight contribute zero.
+type ElixScore struct {
+
+	// Name of the score, used as the column name
+	Name string
+
+	// Weight of each category.  HTN_C is the combined (complicated or
+	// uncomplicated) hypertension category.
+	Weights map[string]int
+}
+
+// Score returns the score for a subject having the given categories
+// (indices into names).
+func (es *ElixScore) Score(names []string, cats []int) int {
+
+	var score int
+	var htn bool
+	for _, j := range cats {
+		c := names[j]
+		score += es.Weights[c]
+		if c == "HTN" || c == "HTNCX" {
+			htn = true
+		}
+	}
+
+	if htn {
+		score += es.Weights["HTN_C"]
+	}
+
+	return score
+}
+
+var (
+	// VanWalraven is the van Walraven et al. (Med Care 2009) score for
+	// in-hospital mortality.  The AHRQ category definitions have no
+	// cardiac arrhythmia category, its weight (5) only counts if the
+	// Elixhauser configuration defines ARRHYTH.
+	VanWalraven = &ElixScore{
+		Name: "VanWalraven",
+		Weights: map[string]int{
+			"CHF": 7, "ARRHYTH": 5, "VALVE": -1, "PULMCIRC": 4, "PERIVASC": 2, "PARA": 7,
+			"NEURO": 6, "CHRNLUNG": 3, "RENLFAIL": 5, "LIVER": 11, "LYMPH": 9,
+			"METS": 12, "TUMOR": 4, "COAG": 3, "OBESE": -4, "WGHTLOSS": 6,
+			"LYTES": 5, "BLDLOSS": -2, "ANEMDEF": -2, "DRUG": -7, "DEPRESS": -3,
+		},
+	}
+
+	// AHRQReadmit is the AHRQ Elixhauser index for 30-day readmission
+	// (Moore et al., Med Care 2017).
+	AHRQReadmit = &ElixScore{
+		Name: "AHRQReadmit",
+		Weights: map[string]int{
+			"AIDS": 5, "ALCOHOL": 3, "ANEMDEF": 5, "ARTH": 2, "BLDLOSS": 3,
+			"CHF": 13, "CHRNLUNG": 8, "COAG": 2, "DEPRESS": 4, "DMCX": 6,
+			"DRUG": 7, "HTN_C": 4, "LIVER": 10, "LYMPH": 4, "LYTES": 6,
+			"METS": 9, "NEURO": 5, "OBESE": -1, "PARA": 6, "PERIVASC": 4,
+			"PSYCH": 10, "PULMCIRC": 5, "RENLFAIL": 8, "TUMOR": 6, "WGHTLOSS": 6,
+		},
+	}
+
+	// AHRQMort is the AHRQ Elixhauser index for in-hospital mortality
+	// (Moore et al., Med Care 2017).
+	AHRQMort = &ElixScore{
+		Name: "AHRQMort",
+		Weights: map[string]int{
+			"ALCOHOL": -1, "ANEMDEF": -2, "BLDLOSS": -3, "CHF": 9, "CHRNLUNG": 3,
+			"COAG": 11, "DEPRESS": -5, "DMCX": -3, "DRUG": -7, "HTN_C": -1,
+			"LIVER": 4, "LYMPH": 6, "LYTES": 11, "METS": 14, "NEURO": 5,
+			"OBESE": -5, "PARA": 5, "PERIVASC": 3, "PSYCH": -5, "PULMCIRC": 6,
+			"RENLFAIL": 6, "TUMOR": 7, "WGHTLOSS": 9,
+		},
+	}
+
+	// ElixScores contains the scores written by data.go.
+	ElixScores = []*ElixScore{VanWalraven, AHRQReadmit, AHRQMort}
+)
@@ -0,0 +1,52 @@
+package utils
+
+import "testing"
+
+func TestVanWalraven(t *testing.T) {
+
+	// The categories of van Walraven et al. (2009), in the AHRQ
+	// abbreviations
+	names := []string{"CHF", "ARRHYTH", "VALVE", "PULMCIRC", "PERIVASC", "HTN", "HTNCX",
+		"PARA", "NEURO", "CHRNLUNG", "DM", "DMCX", "HYPOTHY", "RENLFAIL", "LIVER", "ULCER",
+		"AIDS", "LYMPH", "METS", "TUMOR", "ARTH", "COAG", "OBESE", "WGHTLOSS", "LYTES",
+		"BLDLOSS", "ANEMDEF", "ALCOHOL", "DRUG", "PSYCH", "DEPRESS"}
+	index := make(map[string]int)
+	for j, c := range names {
+		index[c] = j
+	}
+	cats := func(c ...string) []int {
+		var u []int
+		for _, x := range c {
+			u = append(u, index[x])
+		}
+		return u
+	}
+
+	// The published score ranges from -19, with all the categories
+	// of negative weight, to 89, with all those of positive weight.
+	var neg, pos []int
+	for j, c := range names {
+		switch w := VanWalraven.Weights[c]; {
+		case w < 0:
+			neg = append(neg, j)
+		case w > 0:
+			pos = append(pos, j)
+		}
+	}
+
+	for _, tc := range []struct {
+		cats  []int
+		score int
+	}{
+		{nil, 0},
+		{neg, -19},
+		{pos, 89},
+		{cats("CHF", "ARRHYTH"), 12},
+		{cats("CHF", "HTN", "DM", "DEPRESS"), 4},
+		{cats("RENLFAIL", "LYTES", "DRUG"), 3},
+	} {
+		if s := VanWalraven.Score(names, tc.cats); s != tc.score {
+			t.Errorf("%v: got %d, want %d", tc.cats, s, tc.score)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// HeaderVersion is the version of the layout of hfdat.gob.gz (the
+// Header and Drec types).  It must be incremented whenever a field
+// is added to or removed from either type, or the meaning of a field
+// changes.
+//
+//	0  files written before the header was versioned
+//	1  adds Version, Created, Thrgrp, Procgrp, CodeSets and Configs
+//	2  adds Drec.ElixSrc and Drec.HfSrc
+//	3  adds Revision and Previous, and the subject states (cohort.State)
+//	   kept in the shard directory with -save-state
+const HeaderVersion = 3
+
+// Number of drug therapeutic groups and of procedure groups
+const (
+	NumThrgrp  = 31
+	NumProcgrp = 500
+)
+
+// CodeSetVersion identifies one of the code sets used to build the
+// file.
+type CodeSetVersion struct {
+
+	// Name of the code set, or of the file it was read from
+	Name string
+
+	// Version of the code set (name@version), or the SHA-256 digest
+	// of the file
+	Version string
+}
+
+// Header is the first value written to hfdat.gob.gz, preceding the
+// subject records.
+type Header struct {
+
+	// The layout version, HeaderVersion when written
+	Version int
+
+	// Time at which the file was written (RFC 3339, UTC), see
+	// CreationTime
+	Created string
+
+	// Names of the Elixhauser categories
+	Elix []string
+
+	// Names of the Charlson categories
+	Charlson []string
+
+	// Names of the drug therapeutic groups, Drec.Thrgrp holds
+	// indices into this array.  These are the MarketScan codes "1",
+	// "2", ..., see GroupNames, not descriptive labels.
+	Thrgrp []string
+
+	// Names of the procedure groups, Drec.Procgrp holds indices into
+	// this array.  These are also the MarketScan codes.
+	Procgrp []string
+
+	// Name and version of the outcome definition
+	Outcome string
+
+	// The code sets used to build the file
+	CodeSets []CodeSetVersion
+
+	// Paths of the table configuration directories, in the order of
+	// Spec.Tables
+	Configs []string
+
+	// Revision of the cohort, 1 for a full run, incremented by each
+	// refresh
+	Revision int
+
+	// For a refreshed cohort, the shard directory of the run that
+	// was refreshed
+	Previous string
+
+	// If true, the ID field of each record is a keyed pseudonym
+	// rather than the enrollee id
+	PseudoID bool
+
+	// The cohort definition used to build the file
+	Spec CohortSpec
+}
+
+// GroupNames returns the names of the drug therapeutic groups or
+// procedure groups, which are the MarketScan codes 1, ..., n as
+// strings.  hfdat has no labels for the groups.
+func GroupNames(n int) []string {
+	u := make([]string, n)
+	for i := range u {
+		u[i] = strconv.Itoa(i + 1)
+	}
+	return u
+}
+
+// CreationTime returns the time to record in Header.Created.  If
+// SOURCE_DATE_EPOCH is set, it is used in place of the current time,
+// so that the output is reproducible.
+func CreationTime() (string, error) {
+	t := time.Now()
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("SOURCE_DATE_EPOCH: %v", err)
+		}
+		t = time.Unix(sec, 0)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// upgrade fills in the fields that are missing from the header of a
+// file written before the header was versioned.
+func (hdr *Header) upgrade() {
+	if hdr.Thrgrp == nil {
+		hdr.Thrgrp = GroupNames(NumThrgrp)
+	}
+	if hdr.Procgrp == nil {
+		hdr.Procgrp = GroupNames(NumProcgrp)
+	}
+	if hdr.Revision == 0 {
+		hdr.Revision = 1
+	}
+	if len(hdr.Spec.Tables) == 0 {
+		hdr.Spec = *DefaultSpec()
+	}
+	if hdr.Outcome == "" {
+		if cs, err := hdr.Spec.Outcome.CodeSet(); err == nil {
+			hdr.Outcome = cs.String()
+		}
+	}
+}
+
+// ConfigDir returns the configuration directory of the named table
+// recorded in the header, or "" if the file does not record it
+// (version 0) or the directory no longer exists.
+func (hdr *Header) ConfigDir(table string) string {
+	j := hdr.Spec.TableIndex(table)
+	if j == -1 || j >= len(hdr.Configs) {
+		return ""
+	}
+	if _, err := os.Stat(hdr.Configs[j]); err != nil {
+		return ""
+	}
+	return hdr.Configs[j]
+}
+
+// CohortReader reads the header and records from a file written by
+// hfdat.
+type CohortReader struct {
+
+	// The header of the file.  Version is the version of the file,
+	// the fields missing from older versions are filled in with the
+	// values that were used at the time.
+	Header *Header
+
+	fid *os.File
+	gid *gzip.Reader
+	dec *gob.Decoder
+}
+
+// open opens the named file for decoding.
+func (cr *CohortReader) open(fname string) error {
+	var err error
+	cr.fid, err = os.Open(fname)
+	if err != nil {
+		return err
+	}
+	cr.gid, err = gzip.NewReader(cr.fid)
+	if err != nil {
+		cr.fid.Close()
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	cr.dec = gob.NewDecoder(cr.gid)
+	return nil
+}
+
+// OpenCohort opens the named file (usually hfdat.gob.gz) and reads
+// its header.  Files from newer versions of hfdat are refused.  The
+// oldest files begin with only the names of the Elixhauser
+// categories, and are read using the default cohort specification.
+func OpenCohort(fname string) (*CohortReader, error) {
+
+	cr := new(CohortReader)
+	if err := cr.open(fname); err != nil {
+		return nil, err
+	}
+
+	hdr := new(Header)
+	err := cr.dec.Decode(hdr)
+	if err != nil {
+		// Try the oldest layout, the decoder can't be reused after
+		// a type mismatch.
+		cr.Close()
+		if err1 := cr.open(fname); err1 != nil {
+			return nil, err1
+		}
+		hdr = new(Header)
+		if err1 := cr.dec.Decode(&hdr.Elix); err1 != nil {
+			cr.Close()
+			return nil, fmt.Errorf("%s: reading header: %v", fname, err)
+		}
+	}
+
+	if hdr.Version > HeaderVersion {
+		cr.Close()
+		return nil, fmt.Errorf("%s: header version %d, this program reads version %d or earlier",
+			fname, hdr.Version, HeaderVersion)
+	}
+	if hdr.Version < HeaderVersion {
+		hdr.upgrade()
+	}
+	cr.Header = hdr
+
+	return cr, nil
+}
+
+// Next reads the next record into r, returning io.EOF at the end of
+// the file.  Records from files written before the header was
+// versioned may lack Event, EventDate and SampProb.  These are filled
+// in as they were then defined: follow-up ended at HfDate for the
+// subjects with heart failure and at CvrgEnd otherwise, and every
+// subject was included in the sample.
+func (cr *CohortReader) Next(r *Drec) error {
+	*r = Drec{}
+	if err := cr.dec.Decode(r); err != nil {
+		return err
+	}
+	if cr.Header.Version > 0 {
+		return nil
+	}
+	if r.EventDate == 0 {
+		if r.Hf {
+			r.Event, r.EventDate = EventHF, r.HfDate
+		} else {
+			r.Event, r.EventDate = EventCensored, r.CvrgEnd
+		}
+	}
+	if r.SampProb == 0 {
+		r.SampProb = 1
+	}
+	return nil
+}
+
+// Close closes the file.
+func (cr *CohortReader) Close() error {
+	cr.gid.Close()
+	return cr.fid.Close()
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeCohort writes the header and records to a gzipped gob file in
+// a temporary directory, returning the file name.
+func writeCohort(t *testing.T, hdr interface{}, recs []interface{}) string {
+	fname := filepath.Join(t.TempDir(), "hfdat.gob.gz")
+	fid, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gid := gzip.NewWriter(fid)
+	enc := gob.NewEncoder(gid)
+	if err := enc.Encode(hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		if err := enc.Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gid.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fid.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// readCohort reads all the records of the named file.
+func readCohort(t *testing.T, fname string) (*Header, []Drec) {
+	cr, err := OpenCohort(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	var recs []Drec
+	for {
+		var r Drec
+		err := cr.Next(&r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, r)
+	}
+	return cr.Header, recs
+}
+
+// The subject record of the oldest files
+type drec0 struct {
+	Hf        bool
+	HfDate    uint16
+	CvrgStart uint16
+	CvrgEnd   uint16
+	DOB       uint16
+	Sex       uint8
+	Elix      []int
+	Thrgrp    []int
+	Procgrp   []int
+}
+
+func TestReadVersion0(t *testing.T) {
+
+	elix := []string{"CHF", "DM"}
+	fname := writeCohort(t, elix, []interface{}{
+		drec0{Hf: true, HfDate: 19500, CvrgStart: 18000, CvrgEnd: 20000, DOB: 5000, Sex: 2,
+			Elix: []int{1}},
+		drec0{CvrgStart: 18000, CvrgEnd: 20500, DOB: 6000, Sex: 1},
+	})
+
+	hdr, recs := readCohort(t, fname)
+	if hdr.Version != 0 || !reflect.DeepEqual(hdr.Elix, elix) || hdr.Revision != 1 {
+		t.Errorf("header: got %+v", hdr)
+	}
+	if len(hdr.Thrgrp) != NumThrgrp || len(hdr.Procgrp) != NumProcgrp {
+		t.Errorf("got %d drug groups and %d procedure groups", len(hdr.Thrgrp), len(hdr.Procgrp))
+	}
+
+	want := []Drec{
+		{Hf: true, HfDate: 19500, Event: EventHF, EventDate: 19500, CvrgStart: 18000,
+			CvrgEnd: 20000, DOB: 5000, Sex: 2, SampProb: 1, Elix: []int{1}},
+		{Event: EventCensored, EventDate: 20500, CvrgStart: 18000, CvrgEnd: 20500,
+			DOB: 6000, Sex: 1, SampProb: 1},
+	}
+	if !reflect.DeepEqual(recs, want) {
+		t.Errorf("records:\ngot  %+v\nwant %+v", recs, want)
+	}
+}
+
+func TestReadVersion1(t *testing.T) {
+
+	hdr1 := &Header{
+		Version:  1,
+		Created:  "2020-01-01T00:00:00Z",
+		Elix:     []string{"CHF", "DM"},
+		Thrgrp:   GroupNames(2),
+		Procgrp:  GroupNames(3),
+		Configs:  []string{"a", "d"},
+		Spec:     *DefaultSpec(),
+		Outcome:  "hf@1",
+		CodeSets: []CodeSetVersion{{"hf", "hf@1"}},
+	}
+
+	// Death before heart failure, and a sampled control whose
+	// follow-up ends before the end of coverage.
+	in := []Drec{
+		{ID: 7, Event: EventDeath, EventDate: 19000, CvrgStart: 18000, CvrgEnd: 19000,
+			DOB: 5000, Sex: 1, SampProb: 1, Thrgrp: []int{0}},
+		{ID: 9, Event: EventCensored, EventDate: 19800, CvrgStart: 18000, CvrgEnd: 20000,
+			DOB: 6000, Sex: 2, SampProb: 0.25, Procgrp: []int{2}},
+	}
+	var recs []interface{}
+	for _, r := range in {
+		recs = append(recs, r)
+	}
+	fname := writeCohort(t, hdr1, recs)
+
+	hdr, got := readCohort(t, fname)
+	if hdr.Version != 1 || hdr.Revision != 1 || hdr.Outcome != "hf@1" {
+		t.Errorf("header: got %+v", hdr)
+	}
+	if !reflect.DeepEqual(hdr.Thrgrp, hdr1.Thrgrp) || !reflect.DeepEqual(hdr.Configs, hdr1.Configs) {
+		t.Errorf("header: got %+v", hdr)
+	}
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("records:\ngot  %+v\nwant %+v", got, in)
+	}
+}
+
+func TestReadNewer(t *testing.T) {
+	fname := writeCohort(t, &Header{Version: HeaderVersion + 1}, nil)
+	if _, err := OpenCohort(fname); err == nil {
+		t.Errorf("file from a newer version was accepted")
+	}
+}
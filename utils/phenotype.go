@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+)
+
+// HFDx is one heart failure diagnosis code seen in the claims.
+type HFDx struct {
+
+	// Date of the claim
+	Date uint16
+
+	// The claim is from an inpatient table (I or S)
+	Inpatient bool
+
+	// The code is in the primary position (Dx1)
+	Primary bool
+
+	// Where the code was seen, see DxSource
+	Src uint8
+}
+
+// InpatientTable returns true if the named table contains inpatient
+// claims.
+func InpatientTable(name string) bool {
+	return name == "I" || name == "S"
+}
+
+// Phenotype is a rule that determines whether, and when, a subject
+// has heart failure, based on their heart failure diagnoses.
+type Phenotype struct {
+
+	// Name of the rule
+	Name string
+
+	// A short description of the rule
+	Description string
+
+	// Date returns the date on which the rule is first satisfied, and
+	// false if it is never satisfied.  The diagnoses are sorted by
+	// date.  gap is the minimum number of days between diagnoses for
+	// rules that need more than one.
+	Date func(dx []HFDx, gap int) (uint16, bool)
+}
+
+// secondOutpatient returns the date of the first outpatient diagnosis
+// that follows an earlier outpatient diagnosis by at least gap days.
+func secondOutpatient(dx []HFDx, gap int) (uint16, bool) {
+	var first uint16
+	var seen bool
+	for _, d := range dx {
+		if d.Inpatient {
+			continue
+		}
+		if !seen {
+			first, seen = d.Date, true
+			continue
+		}
+		if int(d.Date)-int(first) >= gap {
+			return d.Date, true
+		}
+	}
+	return 0, false
+}
+
+var (
+	// AnyHF is satisfied by any heart failure diagnosis.
+	AnyHF = &Phenotype{
+		Name:        "any",
+		Description: "Any heart failure diagnosis, in any table and position",
+		Date: func(dx []HFDx, gap int) (uint16, bool) {
+			if len(dx) == 0 {
+				return 0, false
+			}
+			return dx[0].Date, true
+		},
+	}
+
+	// InpatientPrimaryHF is satisfied by an inpatient diagnosis in the
+	// primary position.
+	InpatientPrimaryHF = &Phenotype{
+		Name:        "inpatient_primary",
+		Description: "One inpatient heart failure diagnosis in the primary position",
+		Date: func(dx []HFDx, gap int) (uint16, bool) {
+			for _, d := range dx {
+				if d.Inpatient && d.Primary {
+					return d.Date, true
+				}
+			}
+			return 0, false
+		},
+	}
+
+	// InpatientOr2OutpatientHF is satisfied by an inpatient primary
+	// diagnosis, or by two outpatient diagnoses at least gap days
+	// apart, dated at the second of these.
+	InpatientOr2OutpatientHF = &Phenotype{
+		Name:        "inpatient_or_2_outpatient",
+		Description: "One inpatient primary heart failure diagnosis, or two outpatient diagnoses at least Outcome.GapDays apart",
+		Date: func(dx []HFDx, gap int) (uint16, bool) {
+			d1, ok1 := InpatientPrimaryHF.Date(dx, gap)
+			d2, ok2 := secondOutpatient(dx, gap)
+			switch {
+			case ok1 && ok2:
+				if d2 < d1 {
+					return d2, true
+				}
+				return d1, true
+			case ok1:
+				return d1, true
+			case ok2:
+				return d2, true
+			}
+			return 0, false
+		},
+	}
+
+	// Phenotypes contains all available phenotype rules.
+	Phenotypes = []*Phenotype{AnyHF, InpatientPrimaryHF, InpatientOr2OutpatientHF}
+)
+
+// LookupPhenotype returns the phenotype rule with the given name.  The
+// empty name selects AnyHF.
+func LookupPhenotype(name string) (*Phenotype, error) {
+
+	if name == "" {
+		return AnyHF, nil
+	}
+
+	for _, p := range Phenotypes {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown phenotype '%s'", name)
+}
+
+// SortHFDx sorts the diagnoses by date.
+func SortHFDx(dx []HFDx) {
+	sort.Slice(dx, func(i, j int) bool { return dx[i].Date < dx[j].Date })
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// Minimum length of a pseudonymization key in bytes
+	minKeyLen = 16
+
+	// Pseudonyms are truncated to this many bits so that they can
+	// be stored exactly in a float64 column.
+	pseudoBits = 53
+)
+
+// ReadKey reads a pseudonymization key from a file.  Leading and
+// trailing white space is removed.
+func ReadKey(fname string) ([]byte, error) {
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	b = bytes.TrimSpace(b)
+	if len(b) < minKeyLen {
+		return nil, fmt.Errorf("%s: key must contain at least %d bytes", fname, minKeyLen)
+	}
+
+	return b, nil
+}
+
+// Pseudonym returns a keyed pseudonym for an enrollee id, formed from
+// the leading bits of the HMAC-SHA256 of the id.  The same key and id
+// always give the same pseudonym, but the id can not be recovered
+// without the key.
+func Pseudonym(key []byte, id uint64) uint64 {
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], id)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[:])
+	h := mac.Sum(nil)
+
+	return binary.BigEndian.Uint64(h[0:8]) >> (64 - pseudoBits)
+}
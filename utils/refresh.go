@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// RefreshDiff counts the changes made to the cohort when it is
+// refreshed with a new year of claims.  A subject is in the cohort if
+// it has a record, before any nested case-control sampling.
+type RefreshDiff struct {
+
+	// Number of subjects, and the number first seen in the new
+	// claims
+	Subjects    int
+	NewSubjects int
+
+	// Subjects added to and removed from the cohort
+	Added   int
+	Removed int
+
+	// Subjects in the cohort after the refresh who have heart
+	// failure, or died, and did not before
+	NewCases  int
+	NewDeaths int
+
+	// Subjects in the cohort before and after the refresh whose
+	// follow-up was extended without an event
+	Extended int
+
+	// Subjects in the cohort before and after the refresh whose
+	// records are unchanged
+	Unchanged int
+
+	// Subjects whose baseline window moved, see AttrStale
+	Stale int
+}
+
+// Compare counts the changes to one subject, whose record before the
+// refresh was old and after the refresh is cur.  The records are nil
+// if the subject is not in the cohort, in which case reason is the
+// reason given for cur.
+func (d *RefreshDiff) Compare(old, cur *Drec, reason string, newSubject bool) {
+
+	d.Subjects++
+	if newSubject {
+		d.NewSubjects++
+	}
+	if reason == AttrStale {
+		d.Stale++
+	}
+
+	switch {
+	case old == nil && cur == nil:
+		return
+	case old == nil:
+		d.Added++
+	case cur == nil:
+		d.Removed++
+		return
+	}
+
+	if cur.Event == EventHF && (old == nil || old.Event != EventHF) {
+		d.NewCases++
+	}
+	if cur.Event == EventDeath && (old == nil || old.Event != EventDeath) {
+		d.NewDeaths++
+	}
+	if old == nil {
+		return
+	}
+
+	switch {
+	case cur.Event == old.Event && cur.EventDate == old.EventDate:
+		d.Unchanged++
+	case cur.Event == EventCensored && old.Event == EventCensored && cur.EventDate > old.EventDate:
+		d.Extended++
+	}
+}
+
+// Add adds the counts in b to d.
+func (d *RefreshDiff) Add(b *RefreshDiff) {
+	d.Subjects += b.Subjects
+	d.NewSubjects += b.NewSubjects
+	d.Added += b.Added
+	d.Removed += b.Removed
+	d.NewCases += b.NewCases
+	d.NewDeaths += b.NewDeaths
+	d.Extended += b.Extended
+	d.Unchanged += b.Unchanged
+	d.Stale += b.Stale
+}
+
+// Table returns a printable summary.
+func (d *RefreshDiff) Table() string {
+
+	var buf bytes.Buffer
+	for _, x := range []struct {
+		name string
+		n    int
+	}{
+		{"Subjects", d.Subjects},
+		{"  first seen in the new claims", d.NewSubjects},
+		{"Added to the cohort", d.Added},
+		{"Removed from the cohort", d.Removed},
+		{"New cases", d.NewCases},
+		{"New deaths", d.NewDeaths},
+		{"Follow-up extended", d.Extended},
+		{"Unchanged", d.Unchanged},
+		{"Baseline window moved", d.Stale},
+	} {
+		fmt.Fprintf(&buf, "%-45s %12d\n", x.name, x.n)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,60 @@
+package utils
+
+// mix64 is the finalizer of the splitmix64 generator, which maps
+// distinct inputs to well-mixed 64 bit outputs.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// SampleUniform returns a value in [0, 1) that depends only on the
+// seed and the subject id.  A subject is retained with probability p
+// by retaining it when SampleUniform(seed, id) < p.
+func SampleUniform(seed, id uint64) float64 {
+	h := mix64(seed ^ mix64(id))
+	return float64(h>>11) / (1 << 53)
+}
+
+// StratumRate is the sampling rate for non-cases in one age/sex
+// stratum.
+type StratumRate struct {
+
+	// The stratum contains ages (at the start of coverage) in
+	// [AgeMin, AgeMax)
+	AgeMin, AgeMax int
+
+	// Sex of the stratum, 1 (male) or 2 (female), or 0 for both
+	Sex uint8
+
+	// Proportion of the non-cases in the stratum that are retained
+	Rate float64
+}
+
+// SamplingSpec describes the random subsampling of non-cases.
+type SamplingSpec struct {
+
+	// Seed for the sampling, a subject is retained or not based only
+	// on the seed and the subject id
+	Seed uint64
+
+	// Proportion of the non-cases that are retained, for subjects
+	// not in any of the strata
+	Rate float64
+
+	// Sampling rates by age and sex, the first matching stratum is
+	// used
+	Strata []StratumRate
+}
+
+// RateFor returns the sampling rate for a non-case with the given
+// age and sex.
+func (s *SamplingSpec) RateFor(age int, sex uint8) float64 {
+	for _, st := range s.Strata {
+		if age >= st.AgeMin && age < st.AgeMax && (st.Sex == 0 || st.Sex == sex) {
+			return st.Rate
+		}
+	}
+	return s.Rate
+}
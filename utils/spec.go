@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// TableSpec describes one of the claims tables used to build the cohort.
+type TableSpec struct {
+
+	// Short name of the table (A, O, S, I, F, D)
+	Name string
+
+	// Directory containing the gocols configuration for the table
+	Dir string
+
+	// Name of the variable holding the date of each row
+	DateVar string
+
+	// Columns to read from the table
+	Columns []string
+}
+
+// Has returns true if the column is read from the table.
+func (t *TableSpec) Has(col string) bool {
+	for _, c := range t.Columns {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// OutcomeSpec describes the codes that define the outcome.
+type OutcomeSpec struct {
+
+	// Name of one of the definitions in OutcomeDefs, optionally
+	// followed by "@version"
+	Definition string
+
+	// ICD-9 and ICD-10 codes defining the outcome, used instead of
+	// Definition if either is not empty.  See CodeSet for the
+	// format.
+	ICD9  []string
+	ICD10 []string
+
+	// Name of one of the rules in Phenotypes, determining which
+	// diagnoses identify heart failure and the date of onset
+	Phenotype string
+
+	// Minimum number of days between diagnoses, for phenotype rules
+	// that need more than one
+	GapDays int
+}
+
+// CodeSet returns the code set that defines the outcome.
+func (o *OutcomeSpec) CodeSet() (*CodeSet, error) {
+
+	if len(o.ICD9) > 0 || len(o.ICD10) > 0 {
+		cs := &CodeSet{
+			Name:        "custom",
+			Description: "Codes given in the cohort specification",
+			ICD9:        o.ICD9,
+			ICD10:       o.ICD10,
+		}
+		return cs, nil
+	}
+
+	return LookupOutcome(o.Definition)
+}
+
+// Sampling designs
+const (
+	// All cases and a random sample of the non-cases
+	DesignSRS = "srs"
+
+	// Nested case-control, each case is matched to controls drawn
+	// from its risk set
+	DesignNCC = "ncc"
+
+	// A random subcohort, plus all cases
+	DesignCaseCohort = "casecohort"
+)
+
+// Counting-process interval types
+const (
+	// A new interval begins on each anniversary of the start of
+	// follow-up
+	IntervalsYearly = "yearly"
+
+	// A new interval begins whenever a new Elixhauser category or
+	// drug therapeutic group is first seen
+	IntervalsDx = "dx"
+)
+
+// DeathSpec describes how deaths are identified.
+type DeathSpec struct {
+
+	// Identify deaths from the discharge status (Dstatus) of
+	// inpatient admissions
+	Discharge bool
+
+	// Identify probable deaths from disenrollment: enrollment ends
+	// part way through a year, within Window days after an inpatient
+	// discharge.  The date of death is the end of enrollment.
+	Disenroll bool
+
+	// Number of days for the disenrollment rule
+	Window int
+}
+
+// CohortSpec describes how the cohort is constructed from the
+// claims tables.
+type CohortSpec struct {
+
+	// The source tables, the first of which must be the A table
+	Tables []TableSpec
+
+	// Exclude a person for one year if they do not have this many
+	// days of coverage in the year
+	MinCoverage int
+
+	// Length of the baseline window in days, starting on the first
+	// day of coverage
+	BaselineDays int
+
+	// Length of the prediction window in days, following the
+	// baseline window.  If zero, follow-up continues to the end of
+	// coverage.
+	PredictionDays int
+
+	// The outcome definition
+	Outcome OutcomeSpec
+
+	// Subsampling of the non-cases.  For the case-cohort design this
+	// gives the sampling of the subcohort.
+	Controls SamplingSpec
+
+	// The sampling design, one of DesignSRS, DesignNCC or
+	// DesignCaseCohort
+	Design string
+
+	// Number of controls matched to each case in the nested
+	// case-control design
+	NCCControls int
+
+	// If not empty, each record also contains counting-process
+	// intervals, one of IntervalsYearly or IntervalsDx
+	Intervals string
+
+	// Identification of deaths, which compete with heart failure
+	Death DeathSpec
+}
+
+// DefaultSpec returns the cohort definition used when no
+// specification file is provided.
+func DefaultSpec() *CohortSpec {
+
+	dx := func(n int) []string {
+		var u []string
+		for j := 1; j <= n; j++ {
+			u = append(u, fmt.Sprintf("Dx%d", j))
+		}
+		return u
+	}
+
+	return &CohortSpec{
+		Tables: []TableSpec{
+			{
+				Name:    "A",
+				DateVar: "Year",
+				Columns: []string{"Enrolid", "Year", "Memdays", "Dobyr", "Region", "Emprel", "Sex"},
+			},
+			{
+				Name:    "O",
+				DateVar: "Svcdate",
+				Columns: append([]string{"Enrolid", "Svcdate", "Procgrp", "Stdplac"}, dx(4)...),
+			},
+			{
+				Name:    "S",
+				DateVar: "Svcdate",
+				Columns: append([]string{"Enrolid", "Svcdate", "Procgrp", "Stdplac"}, dx(2)...),
+			},
+			{
+				Name:    "I",
+				DateVar: "Admdate",
+				Columns: append([]string{"Enrolid", "Admdate", "Disdate", "Dstatus", "Procgrp"}, dx(15)...),
+			},
+			{
+				Name:    "F",
+				DateVar: "Svcdate",
+				Columns: append([]string{"Enrolid", "Svcdate", "Procgrp", "Stdplac"}, dx(9)...),
+			},
+			{
+				Name:    "D",
+				DateVar: "Svcdate",
+				Columns: []string{"Enrolid", "Svcdate", "Thergrp", "Daysupp", "Ndcnum"},
+			},
+		},
+		MinCoverage:  360,
+		BaselineDays: 365,
+		Outcome:      OutcomeSpec{Definition: "elix_chf", Phenotype: "any", GapDays: 30},
+		Controls:     SamplingSpec{Rate: 0.1},
+		Design:       DesignSRS,
+		NCCControls:  5,
+		Death:        DeathSpec{Discharge: true, Disenroll: true, Window: 30},
+	}
+}
+
+// ReadSpec reads a cohort specification from a JSON file.  Values
+// that are not present in the file are taken from DefaultSpec.
+func ReadSpec(fname string) (*CohortSpec, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	spec := DefaultSpec()
+	dec := json.NewDecoder(fid)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return spec, nil
+}
+
+// Validate checks the specification for consistency.
+func (spec *CohortSpec) Validate() error {
+
+	if len(spec.Tables) == 0 || spec.Tables[0].Name != "A" {
+		return fmt.Errorf("the first table must be the A table")
+	}
+
+	// The tables in which a procedure is seen are stored as bits of
+	// a uint8, see Drec.ProcSrc.
+	if len(spec.Tables) > 8 {
+		return fmt.Errorf("at most 8 tables can be used")
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range spec.Tables {
+		if seen[t.Name] {
+			return fmt.Errorf("table %s appears more than once", t.Name)
+		}
+		seen[t.Name] = true
+		if t.DateVar == "" {
+			return fmt.Errorf("table %s has no date variable", t.Name)
+		}
+	}
+
+	// Columns read for every subject, and by the enabled features
+	need := map[string][]string{
+		"A": {"Year", "Memdays", "Dobyr", "Sex", "Region", "Emprel"},
+		"D": {"Thergrp"},
+	}
+	if spec.Death.Discharge || spec.Death.Disenroll {
+		need["I"] = []string{"Dstatus", "Disdate"}
+	}
+	for _, t := range spec.Tables {
+		for _, c := range append([]string{"Enrolid", t.DateVar}, need[t.Name]...) {
+			if !t.Has(c) {
+				return fmt.Errorf("table %s does not read the %s column", t.Name, c)
+			}
+		}
+	}
+
+	if spec.MinCoverage <= 0 || spec.MinCoverage > 366 {
+		return fmt.Errorf("MinCoverage must be between 1 and 366")
+	}
+
+	if spec.BaselineDays <= 0 {
+		return fmt.Errorf("BaselineDays must be positive")
+	}
+
+	if spec.PredictionDays < 0 {
+		return fmt.Errorf("PredictionDays must be non-negative")
+	}
+
+	if _, err := spec.Outcome.CodeSet(); err != nil {
+		return err
+	}
+	if _, err := LookupPhenotype(spec.Outcome.Phenotype); err != nil {
+		return err
+	}
+	if spec.Outcome.GapDays < 0 {
+		return fmt.Errorf("Outcome.GapDays must be non-negative")
+	}
+
+	if spec.Controls.Rate <= 0 || spec.Controls.Rate > 1 {
+		return fmt.Errorf("Controls.Rate must be in (0, 1]")
+	}
+	for _, st := range spec.Controls.Strata {
+		if st.Rate <= 0 || st.Rate > 1 {
+			return fmt.Errorf("Controls.Strata rates must be in (0, 1]")
+		}
+	}
+
+	switch spec.Design {
+	case DesignSRS, DesignCaseCohort:
+	case DesignNCC:
+		if spec.NCCControls <= 0 {
+			return fmt.Errorf("NCCControls must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown design '%s'", spec.Design)
+	}
+
+	if spec.Death.Disenroll && spec.Death.Window <= 0 {
+		return fmt.Errorf("Death.Window must be positive")
+	}
+
+	switch spec.Intervals {
+	case "", IntervalsYearly, IntervalsDx:
+	default:
+		return fmt.Errorf("unknown interval type '%s'", spec.Intervals)
+	}
+	if spec.Intervals != "" && spec.Design == DesignNCC {
+		return fmt.Errorf("intervals can not be used with the nested case-control design")
+	}
+
+	return nil
+}
+
+// TableIndex returns the position of the named table in the
+// specification, or -1 if the table is not present.
+func (spec *CohortSpec) TableIndex(name string) int {
+	for j, t := range spec.Tables {
+		if t.Name == name {
+			return j
+		}
+	}
+	return -1
+}
+
+// FollowupEnd returns the last day of follow-up for a subject with
+// the given coverage window, accounting for the prediction window.
+func (spec *CohortSpec) FollowupEnd(cvrgstart, cvrgend uint16) uint16 {
+	if spec.PredictionDays > 0 {
+		e := int(cvrgstart) + spec.BaselineDays + spec.PredictionDays
+		if e < int(cvrgend) {
+			return uint16(e)
+		}
+	}
+	return cvrgend
+}